@@ -0,0 +1,111 @@
+package config
+
+import (
+	"reflect"
+	"sync"
+)
+
+// maskedValue replaces values of the fields marked by data-not-logging tag
+const maskedValue = "**********"
+
+type (
+	// Change describes the field value change after config refresh
+	Change struct {
+		Field    string
+		OldValue interface{}
+		NewValue interface{}
+	}
+
+	// ChangeCallback function to handle config changes
+	ChangeCallback func(changes []Change)
+
+	subscription struct {
+		field string
+		cb    ChangeCallback
+	}
+
+	// subscribers keeps change callbacks, it is safe for concurrent use
+	subscribers struct {
+		mu   sync.RWMutex
+		list []subscription
+	}
+)
+
+// add subscription, empty field means all the fields
+func (s *subscribers) add(field string, cb ChangeCallback) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.list = append(s.list, subscription{field: field, cb: cb})
+}
+
+// notify subscribers about changes, every subscriber receives only changes it is subscribed to
+func (s *subscribers) notify(changes []Change) {
+	if len(changes) == 0 {
+		return
+	}
+
+	s.mu.RLock()
+	list := make([]subscription, len(s.list))
+	copy(list, s.list)
+	s.mu.RUnlock()
+
+	for _, sub := range list {
+		if sub.field == "" {
+			sub.cb(changes)
+			continue
+		}
+		for _, change := range changes {
+			if change.Field == sub.field {
+				sub.cb([]Change{change})
+				break
+			}
+		}
+	}
+}
+
+// diffMetas compares field values of two metadata lists of the same structure type,
+// fields are matched by path, so added and removed list items are reported with nil value
+func diffMetas(prev, next []StructMeta) []Change {
+	prevByPath := make(map[string]StructMeta, len(prev))
+	for _, meta := range prev {
+		prevByPath[meta.Path] = meta
+	}
+
+	var changes []Change
+	for _, meta := range next {
+		var oldValue interface{}
+		if prevMeta, ok := prevByPath[meta.Path]; ok {
+			oldValue = prevMeta.FieldValue.Interface()
+			delete(prevByPath, meta.Path)
+		}
+		if change, ok := newChange(meta, oldValue, meta.FieldValue.Interface()); ok {
+			changes = append(changes, change)
+		}
+	}
+	// removed fields are reported in the original order
+	for _, meta := range prev {
+		if _, ok := prevByPath[meta.Path]; !ok {
+			continue
+		}
+		if change, ok := newChange(meta, meta.FieldValue.Interface(), nil); ok {
+			changes = append(changes, change)
+		}
+	}
+
+	return changes
+}
+
+// newChange makes change of the field if values are different, values of the data-not-logging fields are masked
+func newChange(meta StructMeta, oldValue, newValue interface{}) (Change, bool) {
+	if reflect.DeepEqual(oldValue, newValue) {
+		return Change{}, false
+	}
+	if meta.NotLogging {
+		oldValue, newValue = maskedValue, maskedValue
+	}
+	return Change{
+		Field:    meta.Path,
+		OldValue: oldValue,
+		NewValue: newValue,
+	}, true
+}
@@ -0,0 +1,192 @@
+// config-doc generates documentation and env templates of the config structure.
+//
+// Usage:
+//
+//	config-doc -type Config [-dir .] [-format markdown|env|kubernetes|json-schema] [-name app] [-o file]
+//	           [-env-prefix APP_] [-derive-names]
+//
+// Fields are described by DescribeFields of a temporary program, which is run by go run in the package directory,
+// so the documentation matches the metadata used by the readers. The package should be buildable, files of the main
+// package are copied to the temporary program with the main function renamed
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	libConfig "github.com/MiG-21/go-lib-config"
+)
+
+// goPackage is a part of the go list output
+type goPackage struct {
+	Dir        string
+	ImportPath string
+	Name       string
+	GoFiles    []string
+	CgoFiles   []string
+}
+
+// shim is the main file of the temporary program, the identifiers are prefixed to not collide with the copied files
+var shim = template.Must(template.New("shim").Parse(`// Code generated by config-doc. DO NOT EDIT.
+
+package main
+
+import (
+	configDocLib "github.com/MiG-21/go-lib-config"
+	configDocOS "os"
+{{- if .ImportPath}}
+	configDocTarget {{printf "%q" .ImportPath}}
+{{- end}}
+)
+
+func main() {
+	fields, err := configDocLib.DescribeFields(&{{if .ImportPath}}configDocTarget.{{end}}{{.Type}}{}, configDocLib.DescribeOptions{
+		EnvPrefix:   {{printf "%q" .Options.EnvPrefix}},
+		DeriveNames: {{.Options.DeriveNames}},
+	})
+	if err == nil {
+		err = configDocLib.Generate(configDocOS.Stdout, {{printf "%q" .Format}}, {{printf "%q" .Name}}, fields)
+	}
+	if err != nil {
+		configDocOS.Stderr.WriteString(err.Error() + "\n")
+		configDocOS.Exit(1)
+	}
+}
+`))
+
+func main() {
+	dir := flag.String("dir", ".", "package directory")
+	typeName := flag.String("type", "", "config structure type name")
+	format := flag.String("format", libConfig.FormatMarkdown, "output format: markdown, env, kubernetes, json-schema")
+	name := flag.String("name", "", "kubernetes resource name or schema title, type name by default")
+	output := flag.String("o", "", "output file, stdout by default")
+	var options libConfig.DescribeOptions
+	flag.StringVar(&options.EnvPrefix, "env-prefix", "", "prefix of the variable names, see EnvReader.Prefix")
+	flag.BoolVar(&options.DeriveNames, "derive-names", false, "derive the variable names of the fields without env tag")
+	flag.Parse()
+
+	if *typeName == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *name == "" {
+		*name = strings.ToLower(*typeName)
+	}
+
+	doc, err := generate(*dir, *typeName, *format, *name, options)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(doc)
+	} else {
+		err = ioutil.WriteFile(*output, doc, 0644)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generate runs the temporary program in the package directory and returns its output
+func generate(dir, typeName, format, name string, options libConfig.DescribeOptions) ([]byte, error) {
+	pkg, err := listPackage(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the program is placed inside the package directory, so it's built by the module of the package,
+	// the dot prefix hides it from the ./... patterns
+	tmp, err := ioutil.TempDir(pkg.Dir, ".config-doc-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	importPath := pkg.ImportPath
+	if pkg.Name == "main" {
+		// main package could not be imported, so its files are a part of the program
+		importPath = ""
+		for _, file := range append(pkg.GoFiles, pkg.CgoFiles...) {
+			if err = copyWithoutMain(filepath.Join(pkg.Dir, file), filepath.Join(tmp, file)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var src bytes.Buffer
+	err = shim.Execute(&src, map[string]interface{}{
+		"ImportPath": importPath,
+		"Type":       typeName,
+		"Format":     format,
+		"Name":       name,
+		"Options":    options,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(tmp, "config_doc_main.go"), src.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("go", "run", "./"+filepath.Base(tmp))
+	cmd.Dir = pkg.Dir
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w\n%s", typeName, err, stderr.Bytes())
+	}
+	return stdout.Bytes(), nil
+}
+
+// listPackage resolves the package of the directory by go list
+func listPackage(dir string) (goPackage, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("go", "list", "-json", ".")
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return goPackage{}, fmt.Errorf("go list %s: %w\n%s", dir, err, stderr.Bytes())
+	}
+
+	var pkg goPackage
+	if err = json.Unmarshal(out, &pkg); err != nil {
+		return goPackage{}, fmt.Errorf("go list %s: %w", dir, err)
+	}
+	return pkg, nil
+}
+
+// copyWithoutMain copies Go file of the main package, the main function is renamed to the blank identifier,
+// so the imports of the file are still used
+func copyWithoutMain(src, dst string) error {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, src, nil, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == "main" {
+			fn.Name.Name = "_"
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = format.Node(&buf, fset, f); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, buf.Bytes(), 0644)
+}
@@ -1,13 +1,38 @@
 package config_test
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+
+	libConfig "github.com/MiG-21/go-lib-config"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
 )
 
 func TestConfig(t *testing.T) {
@@ -36,3 +61,626 @@ func setEnv(vars map[string]string) {
 		_ = os.Setenv(k, v)
 	}
 }
+
+// writeVolume emulates kubernetes ConfigMap volume update: files are written into the timestamped directory,
+// then "..data" symlink is atomically swapped and key symlinks are created
+func writeVolume(dir, version string, files map[string]string) {
+	Expect(os.MkdirAll(filepath.Join(dir, version), 0755)).To(Succeed())
+	for name, content := range files {
+		Expect(ioutil.WriteFile(filepath.Join(dir, version, name), []byte(content), 0644)).To(Succeed())
+	}
+	Expect(os.Symlink(version, filepath.Join(dir, "..data_tmp"))).To(Succeed())
+	Expect(os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data"))).To(Succeed())
+	for name := range files {
+		if _, err := os.Lstat(filepath.Join(dir, name)); os.IsNotExist(err) {
+			Expect(os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name))).To(Succeed())
+		}
+	}
+}
+
+// updatedCfg sets the untagged field by Updater
+type updatedCfg struct {
+	Host    string `env:"TEST_HOST"`
+	Derived string
+}
+
+func (c *updatedCfg) Update() error {
+	c.Derived = "derived"
+	return nil
+}
+
+type validatorFunc func(i interface{}) error
+
+func (f validatorFunc) Validate(i interface{}) error {
+	return f(i)
+}
+
+// logEntry is a message recorded by recordLogger, fields are keys and values of the message
+type logEntry struct {
+	Level  string
+	Msg    string
+	Fields map[string]interface{}
+}
+
+// recordLogger records messages of all levels
+type recordLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.record("debug", msg, keysAndValues)
+}
+
+func (l *recordLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.record("info", msg, keysAndValues)
+}
+
+func (l *recordLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.record("warn", msg, keysAndValues)
+}
+
+func (l *recordLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.record("error", msg, keysAndValues)
+}
+
+func (l *recordLogger) record(level, msg string, keysAndValues []interface{}) {
+	fields := make(map[string]interface{})
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[fmt.Sprintf("%v", keysAndValues[i])] = keysAndValues[i+1]
+	}
+	l.mu.Lock()
+	l.entries = append(l.entries, logEntry{Level: level, Msg: msg, Fields: fields})
+	l.mu.Unlock()
+}
+
+// messages returns recorded entries of the message
+func (l *recordLogger) messages(msg string) []logEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := make([]logEntry, 0)
+	for _, entry := range l.entries {
+		if entry.Msg == msg {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// formattedValue counts the formatting of the value, e.g. by the debug logging
+type formattedValue string
+
+var formattedCalls int32
+
+func (v formattedValue) String() string {
+	atomic.AddInt32(&formattedCalls, 1)
+	return string(v)
+}
+
+func formattedCount() int32 {
+	return atomic.LoadInt32(&formattedCalls)
+}
+
+type readerFunc func(metas []libConfig.StructMeta) error
+
+func (f readerFunc) Read(metas []libConfig.StructMeta) error {
+	return f(metas)
+}
+
+func (f readerFunc) Stop() {
+	// do nothing
+}
+
+// blockingReader blocks every read except of the first one until the context is cancelled
+type blockingReader struct {
+	calls   int32
+	stopped int32
+}
+
+func (r *blockingReader) Read(metas []libConfig.StructMeta) error {
+	return r.ReadContext(context.Background(), metas)
+}
+
+func (r *blockingReader) ReadContext(ctx context.Context, _ []libConfig.StructMeta) error {
+	if atomic.AddInt32(&r.calls, 1) > 1 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (r *blockingReader) Stop() {
+	atomic.StoreInt32(&r.stopped, 1)
+}
+
+// watchingReader counts reads and notifies about changes by the notify channel
+type watchingReader struct {
+	calls  int32
+	notify chan struct{}
+}
+
+func (r *watchingReader) Read([]libConfig.StructMeta) error {
+	atomic.AddInt32(&r.calls, 1)
+	return nil
+}
+
+func (r *watchingReader) Watch() (<-chan struct{}, error) {
+	return r.notify, nil
+}
+
+func (r *watchingReader) Stop() {
+	// do nothing
+}
+
+func (r *watchingReader) reads() int32 {
+	return atomic.LoadInt32(&r.calls)
+}
+
+// editedReader changes the source of the reader right after Prepare, the changes should not be seen until the next refresh
+type editedReader struct {
+	preparedReader
+	edit func()
+}
+
+type preparedReader interface {
+	libConfig.Reader
+	libConfig.Preparer
+	libConfig.ListSizer
+}
+
+func (r editedReader) Prepare(ctx context.Context) error {
+	err := r.preparedReader.Prepare(ctx)
+	r.edit()
+	return err
+}
+
+type vaultHandler func(r *http.Request, body map[string]interface{}) (int, interface{})
+
+// vaultStub emulates vault HTTP API, handlers are registered by "METHOD /path" key
+type vaultStub struct {
+	*httptest.Server
+	mu       sync.Mutex
+	handlers map[string]vaultHandler
+	calls    map[string]int
+}
+
+func newVaultStub() *vaultStub {
+	stub := initVaultStub()
+	stub.Start()
+	return stub
+}
+
+// newVaultTLSStub starts TLS server which requests client certificate
+func newVaultTLSStub() *vaultStub {
+	stub := initVaultStub()
+	stub.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	stub.StartTLS()
+	return stub
+}
+
+func initVaultStub() *vaultStub {
+	stub := &vaultStub{
+		handlers: make(map[string]vaultHandler),
+		calls:    make(map[string]int),
+	}
+	stub.handle("GET /v1/auth/token/lookup-self", func(r *http.Request, _ map[string]interface{}) (int, interface{}) {
+		return vaultTokenData(r.Header.Get("X-Vault-Token"), time.Hour)
+	})
+	stub.Server = httptest.NewUnstartedServer(http.HandlerFunc(stub.serve))
+	return stub
+}
+
+// vaultTokenData is a lookup-self response
+func vaultTokenData(token string, ttl time.Duration) (int, interface{}) {
+	return http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"id":          token,
+			"ttl":         int(ttl.Seconds()),
+			"renewable":   true,
+			"expire_time": time.Now().Add(ttl).Format(time.RFC3339Nano),
+		},
+	}
+}
+
+// vaultLoginData is a login response
+func vaultLoginData(token string) (int, interface{}) {
+	return http.StatusOK, map[string]interface{}{
+		"auth": map[string]interface{}{
+			"client_token":   token,
+			"lease_duration": 3600,
+			"renewable":      true,
+		},
+	}
+}
+
+func (s *vaultStub) handle(key string, handler vaultHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[key] = handler
+}
+
+func (s *vaultStub) callsOf(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[key]
+}
+
+func (s *vaultStub) serve(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + r.URL.Path
+	s.mu.Lock()
+	handler, ok := s.handlers[key]
+	s.calls[key]++
+	s.mu.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errors":[]}`))
+		return
+	}
+
+	body := make(map[string]interface{})
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	status, response := handler(r, body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// writeClientCert generates self-signed client certificate and key files
+func writeClientCert(dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certPath := filepath.Join(dir, "client.crt")
+	keyPath := filepath.Join(dir, "client.key")
+	Expect(ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)).To(Succeed())
+	return certPath, keyPath
+}
+
+// consulStub emulates Consul KV HTTP API with blocking queries, requests with a token other than "token" are denied
+type consulStub struct {
+	*httptest.Server
+	mu      sync.Mutex
+	index   uint64
+	kv      map[string]string
+	changed chan struct{}
+	// reads are the paths of the non-blocking requests
+	reads []string
+	// requests is the number of all the requests
+	requests int
+	// noIndex turns off X-Consul-Index header, so blocking queries return immediately
+	noIndex bool
+}
+
+func newConsulStub(kv map[string]string) *consulStub {
+	stub := &consulStub{index: 1, kv: kv, changed: make(chan struct{})}
+	stub.Server = httptest.NewServer(http.HandlerFunc(stub.serve))
+	return stub
+}
+
+// put sets the key and wakes up blocking queries
+func (s *consulStub) put(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kv[key] = value
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *consulStub) requestsCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *consulStub) readPaths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.reads...)
+}
+
+func (s *consulStub) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Consul-Token") != "token" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	s.mu.Lock()
+	index, changed := s.index, s.changed
+	s.requests++
+	if r.URL.Query().Get("index") == "" {
+		s.reads = append(s.reads, r.URL.Path)
+	}
+	s.mu.Unlock()
+
+	if r.URL.Query().Get("index") == strconv.FormatUint(index, 10) {
+		wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+		Expect(err).NotTo(HaveOccurred())
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	entries := make([]map[string]interface{}, 0)
+	for key, value := range s.kv {
+		if strings.HasPrefix(key, prefix) {
+			entries = append(entries, map[string]interface{}{
+				"Key":   key,
+				"Value": base64.StdEncoding.EncodeToString([]byte(value)),
+			})
+		}
+	}
+	if !s.noIndex {
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	}
+	if len(entries) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
+
+// etcdStub emulates etcd v3 JSON gateway, requests without token of the root user are denied
+type etcdStub struct {
+	*httptest.Server
+	mu       sync.Mutex
+	revision int64
+	kv       map[string]string
+	// history keeps the revisions of the keys puts
+	history []etcdStubEvent
+	changed chan struct{}
+	// reads are the range and txn requests
+	reads int
+}
+
+type etcdStubEvent struct {
+	key      string
+	revision int64
+}
+
+type etcdStubRange struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+}
+
+// contains checks the key is in the range, the single key is matched if range end is empty
+func (r etcdStubRange) contains(key string) bool {
+	if len(r.RangeEnd) == 0 {
+		return key == string(r.Key)
+	}
+	return key >= string(r.Key) && key < string(r.RangeEnd)
+}
+
+func newEtcdStub(kv map[string]string) *etcdStub {
+	stub := &etcdStub{revision: 1, kv: kv, changed: make(chan struct{})}
+	stub.Server = httptest.NewServer(http.HandlerFunc(stub.serve))
+	return stub
+}
+
+// put sets the key and notifies watchers
+func (s *etcdStub) put(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kv[key] = value
+	s.revision++
+	s.history = append(s.history, etcdStubEvent{key: key, revision: s.revision})
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *etcdStub) readRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
+
+// rangeKvs returns the entries of the range, the lock should be held
+func (s *etcdStub) rangeKvs(rng etcdStubRange) []map[string][]byte {
+	kvs := make([]map[string][]byte, 0)
+	for k, v := range s.kv {
+		if rng.contains(k) {
+			kvs = append(kvs, map[string][]byte{"key": []byte(k), "value": []byte(v)})
+		}
+	}
+	return kvs
+}
+
+func (s *etcdStub) serve(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var body map[string]json.RawMessage
+	_ = decoder.Decode(&body)
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.URL.Path == "/v3/auth/authenticate" {
+		var name, password string
+		_ = json.Unmarshal(body["name"], &name)
+		_ = json.Unmarshal(body["password"], &password)
+		if name != "root" || password != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "token"})
+		return
+	}
+	if r.Header.Get("Authorization") != "token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var rng etcdStubRange
+		_ = json.Unmarshal(body["key"], &rng.Key)
+		_ = json.Unmarshal(body["range_end"], &rng.RangeEnd)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.reads++
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"header": map[string]string{"revision": strconv.FormatInt(s.revision, 10)},
+			"kvs":    s.rangeKvs(rng),
+		})
+
+	case "/v3/kv/txn":
+		var ops []struct {
+			RequestRange etcdStubRange `json:"request_range"`
+		}
+		_ = json.Unmarshal(body["success"], &ops)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.reads++
+		responses := make([]interface{}, len(ops))
+		for i, op := range ops {
+			responses[i] = map[string]interface{}{"response_range": map[string]interface{}{"kvs": s.rangeKvs(op.RequestRange)}}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"header":    map[string]string{"revision": strconv.FormatInt(s.revision, 10)},
+			"succeeded": true,
+			"responses": responses,
+		})
+
+	case "/v3/watch":
+		// a watcher is created per request of the stream
+		var watched []etcdStubRange
+		var startRevision int64
+		for body != nil {
+			var create struct {
+				etcdStubRange
+				StartRevision int64 `json:"start_revision"`
+			}
+			_ = json.Unmarshal(body["create_request"], &create)
+			watched = append(watched, create.etcdStubRange)
+			startRevision = create.StartRevision
+			body = nil
+			_ = decoder.Decode(&body)
+		}
+
+		s.mu.Lock()
+		changed, revision := s.changed, s.revision
+		s.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{
+			"header":  map[string]string{"revision": strconv.FormatInt(revision, 10)},
+			"created": true,
+		}})
+		w.(http.Flusher).Flush()
+
+		// changes since the start revision are sent at once
+		sent := revision
+		if startRevision > 0 {
+			sent = startRevision - 1
+		}
+		for {
+			s.mu.Lock()
+			changed, revision = s.changed, s.revision
+			var events []map[string]string
+			for _, event := range s.history {
+				if event.revision <= sent {
+					continue
+				}
+				for _, rng := range watched {
+					if rng.contains(event.key) {
+						events = append(events, map[string]string{"type": "PUT"})
+						break
+					}
+				}
+			}
+			s.mu.Unlock()
+			sent = revision
+
+			if len(events) > 0 {
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{
+					"header": map[string]string{"revision": strconv.FormatInt(revision, 10)},
+					"events": events,
+				}})
+				w.(http.Flusher).Flush()
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-changed:
+			}
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+type awsHandler func(body map[string]interface{}) (int, interface{})
+
+// awsStub emulates AWS JSON API, handlers are registered by X-Amz-Target header, e.g. "AmazonSSM.GetParameters"
+type awsStub struct {
+	*httptest.Server
+	mu       sync.Mutex
+	handlers map[string]awsHandler
+	calls    map[string]int
+}
+
+func newAWSStub() *awsStub {
+	stub := &awsStub{handlers: make(map[string]awsHandler), calls: make(map[string]int)}
+	stub.Server = httptest.NewServer(http.HandlerFunc(stub.serve))
+	return stub
+}
+
+func (s *awsStub) handle(target string, handler awsHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[target] = handler
+}
+
+func (s *awsStub) callsOf(target string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[target]
+}
+
+// session returns AWS session of the stub endpoint with static credentials
+func (s *awsStub) session() *session.Session {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(s.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return sess
+}
+
+func (s *awsStub) serve(w http.ResponseWriter, r *http.Request) {
+	target := r.Header.Get("X-Amz-Target")
+	s.mu.Lock()
+	handler, ok := s.handlers[target]
+	s.calls[target]++
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"__type": "UnknownOperationException"})
+		return
+	}
+	body := make(map[string]interface{})
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	status, response := handler(body)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
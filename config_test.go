@@ -1,13 +1,31 @@
 package config_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
 
 	libConfig "github.com/MiG-21/go-lib-config"
+	"github.com/go-playground/validator/v10"
+	"github.com/hashicorp/vault/api"
+	"gopkg.in/yaml.v2"
 )
 
 var _ = Describe("Config", func() {
@@ -156,13 +174,665 @@ var _ = Describe("Config", func() {
 			Expect(*(cfg).Boolean).To(Equal(true))
 			Expect(*(cfg).String).To(Equal("test"))
 		})
+
+		It("Prefix and derived names test should be Ok", func() {
+			defer os.Clearenv()
+			setEnv(map[string]string{
+				"APP_NAME":              "app",
+				"APP_HTTP_PORT":         "8080",
+				"APP_PRIMARY_HOST":      "primary",
+				"APP_PRIMARY_MAX_CONNS": "10",
+				"APP_REPLICA_HOST":      "replica",
+				"APP_REPLICA_MAX_CONNS": "5",
+				"APP_CACHE_TTL":         "1m",
+				"APP_LEVEL":             "debug",
+				"APP_SKIPPED":           "skipped",
+				"APP_PASSWORD":          "env",
+				"HTTP_PORT":             "80",
+			})
+
+			type Database struct {
+				Host     string `env:"HOST"`
+				MaxConns int
+			}
+			type Logging struct {
+				Level   string
+				Skipped string `env:"-"`
+			}
+			type TestPrefixCfg struct {
+				Name     string `env:"NAME"`
+				HTTPPort int
+				Primary  Database `env-prefix:"PRIMARY_"`
+				Replica  Database `env-prefix:"REPLICA_"`
+				Cache    struct {
+					TTL time.Duration
+				}
+				Logging
+				// field of another reader is not derived
+				Password string `vault:"secret/app:password"`
+			}
+
+			var cfg TestPrefixCfg
+			reader := libConfig.NewEnvReaderWithPrefix("APP_")
+			reader.DeriveNames = true
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Read(metaInfo)).To(Succeed())
+
+			expected := TestPrefixCfg{
+				Name:     "app",
+				HTTPPort: 8080,
+				Primary:  Database{Host: "primary", MaxConns: 10},
+				Replica:  Database{Host: "replica", MaxConns: 5},
+				Logging:  Logging{Level: "debug"},
+			}
+			expected.Cache.TTL = time.Minute
+			Expect(cfg).To(Equal(expected))
+
+			// documentation doesn't list the variable of the vault field
+			fields, err := libConfig.DescribeFields(&TestPrefixCfg{}, libConfig.DescribeOptions{EnvPrefix: "APP_", DeriveNames: true})
+			Expect(err).NotTo(HaveOccurred())
+			var password libConfig.FieldDoc
+			for _, field := range fields {
+				if field.Name == "Password" {
+					password = field
+				}
+			}
+			Expect(password.Name).To(Equal("Password"))
+			Expect(password.Env).To(BeEmpty())
+
+			// untagged fields are skipped without derivation
+			cfg = TestPrefixCfg{}
+			metaInfo, err = libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(libConfig.NewEnvReaderWithPrefix("APP_").Read(metaInfo)).To(Succeed())
+			Expect(cfg).To(Equal(TestPrefixCfg{
+				Name:    "app",
+				Primary: Database{Host: "primary"},
+				Replica: Database{Host: "replica"},
+			}))
+		})
+
+		It("File indirection test should be Ok", func() {
+			defer os.Clearenv()
+
+			dir, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+			secret := filepath.Join(dir, "password")
+			Expect(ioutil.WriteFile(secret, []byte("s3cret\n"), 0600)).To(Succeed())
+			large := filepath.Join(dir, "large")
+			Expect(ioutil.WriteFile(large, make([]byte, 20), 0600)).To(Succeed())
+
+			setEnv(map[string]string{
+				"PASSWORD_FILE": secret,
+				"USER":          "user",
+				"USER_FILE":     secret,
+				"TOKEN_FILE":    large,
+			})
+
+			type TestFileIndirectionCfg struct {
+				Password string `env:"PASSWORD"`
+				User     string `env:"USER"`
+				Token    string `env:"TOKEN" data-default:"def"`
+			}
+
+			var cfg TestFileIndirectionCfg
+			reader := libConfig.NewEnvReader()
+			reader.FileIndirection = true
+			reader.MaxFileSize = 10
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			err = reader.Read(metaInfo)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("TOKEN_FILE: " + large + " exceeds 10 bytes limit"))
+
+			Expect(cfg.Password).To(Equal("s3cret"))
+			Expect(cfg.User).To(Equal("user"))
+			Expect(metaInfo[0].Provider).To(Equal("env-file"))
+			Expect(metaInfo[1].Provider).To(Equal("env"))
+			Expect(metaInfo[2].Provider).To(Equal("-"))
+
+			// indirection is disabled by default
+			cfg = TestFileIndirectionCfg{}
+			metaInfo, err = libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(libConfig.NewEnvReader().Read(metaInfo)).To(Succeed())
+			Expect(cfg.Password).To(BeEmpty())
+		})
+	})
+
+	Context("FileReader", func() {
+		type TestFileCfg struct {
+			Host     string            `file:"server.host"`
+			Port     int               `file:"server.http.port"`
+			Timeout  time.Duration     `file:"server.timeout" data-default:"5s"`
+			Tags     []string          `file:"tags" data-separator:"|"`
+			Limits   map[string]int    `file:"limits"`
+			Started  time.Time         `file:"started" data-layout:"2006-01-02"`
+			Missing  string            `file:"missing" data-default:"def"`
+			Untagged map[string]string ``
+		}
+
+		expected := TestFileCfg{
+			Host:    "localhost",
+			Port:    8080,
+			Timeout: durationFunc("10s"),
+			Tags:    []string{"a", "b"},
+			Limits:  map[string]int{"x": 1, "z": 2},
+			Started: timeFunc("2021-02-25", "2006-01-02"),
+		}
+
+		read := func(name, content string) (TestFileCfg, []libConfig.StructMeta) {
+			dir, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+			path := filepath.Join(dir, name)
+			Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+
+			var cfg TestFileCfg
+			reader := libConfig.NewFileReader(path)
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			err = reader.Read(metaInfo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metaInfo[0].Provider).To(Equal(path))
+			return cfg, metaInfo
+		}
+
+		It("JSON test should be Ok", func() {
+			cfg, _ := read("config.json", `{
+				"server": {"host": "localhost", "timeout": "10s", "http": {"port": 8080}},
+				"tags": ["a", "b"],
+				"limits": {"x": 1, "z": 2},
+				"started": "2021-02-25"
+			}`)
+			Expect(cfg).To(Equal(expected))
+		})
+
+		It("YAML test should be Ok", func() {
+			cfg, _ := read("config.yaml", `
+server:
+  host: localhost
+  timeout: 10s
+  http:
+    port: 8080
+tags: [a, b]
+limits:
+  x: 1
+  z: 2
+started: "2021-02-25"
+`)
+			Expect(cfg).To(Equal(expected))
+		})
+
+		It("TOML test should be Ok", func() {
+			cfg, _ := read("config.toml", `
+tags = ["a", "b"]
+started = 2021-02-25T00:00:00Z
+
+[server]
+host = "localhost"
+timeout = "10s"
+
+[server.http]
+port = 8080
+
+[limits]
+x = 1
+z = 2
+`)
+			Expect(cfg).To(Equal(expected))
+		})
+
+		It("Edit after Prepare should not be read", func() {
+			dir, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+			path := filepath.Join(dir, "config.json")
+			Expect(ioutil.WriteFile(path, []byte(`{"host": "a", "upstreams": [{"host": "b"}]}`), 0644)).To(Succeed())
+
+			type TestPreparedCfg struct {
+				Host      string `file:"host"`
+				Upstreams []struct {
+					Host string `file:"host"`
+				} `file:"upstreams"`
+			}
+			var cfg TestPreparedCfg
+			reader := editedReader{preparedReader: libConfig.NewFileReader(path), edit: func() {
+				Expect(ioutil.WriteFile(path, []byte(`{"host": "c", "upstreams": [{"host": "d"}, {"host": "e"}]}`), 0644)).To(Succeed())
+			}}
+			_, err = libConfig.NewConfigService(0).ReadAndValidate(&cfg, reader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Host).To(Equal("a"))
+			Expect(cfg.Upstreams).To(HaveLen(1))
+			Expect(cfg.Upstreams[0].Host).To(Equal("b"))
+
+			// the snapshot is used once, the next read loads the file again
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Read(metaInfo)).To(Succeed())
+			Expect(cfg.Host).To(Equal("c"))
+		})
+	})
+
+	Context("DotenvReader", func() {
+		type TestDotenvCfg struct {
+			Host      string   `env:"HOST"`
+			Port      int      `env:"PORT"`
+			URL       string   `env:"URL"`
+			Greeting  string   `env:"GREETING"`
+			Literal   string   `env:"LITERAL"`
+			Cert      string   `env:"CERT"`
+			Tags      []string `env:"TAGS"`
+			User      string   `env:"USER_NAME"`
+			Fallback  string   `env:"FALLBACK"`
+			Unchanged string   `env:"UNCHANGED" data-default:"def"`
+			Color     string   `env:"COLOR"`
+			Comment   string   `env:"COMMENT" data-default:"def"`
+		}
+
+		It("Layered files test should be Ok", func() {
+			defer os.Clearenv()
+			setEnv(map[string]string{"SHELL_USER": "shell"})
+
+			dir, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+			base := filepath.Join(dir, ".env")
+			local := filepath.Join(dir, ".env.local")
+			Expect(ioutil.WriteFile(base, []byte(`# base config
+export HOST=example.com
+PORT=80 # inline comment
+URL=http://${HOST}:${PORT}/path#anchor
+GREETING="hello\t\"world\""
+LITERAL='no ${HOST} \n here'
+CERT="-----BEGIN-----
+line
+-----END-----"
+TAGS=a,b
+USER_NAME=${SHELL_USER}
+FALLBACK=${MISSING:-${HOST}}
+COLOR=#fff
+COMMENT= # empty value
+`), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(local, []byte("PORT=8080\nURL=\"http://$HOST:$PORT\"\n"), 0644)).To(Succeed())
+
+			var cfg TestDotenvCfg
+			reader := libConfig.NewDotenvReader(base, local, filepath.Join(dir, ".env.test"))
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Read(metaInfo)).To(Succeed())
+
+			Expect(cfg).To(Equal(TestDotenvCfg{
+				Host:     "example.com",
+				Port:     8080,
+				URL:      "http://example.com:8080",
+				Greeting: "hello\t\"world\"",
+				Literal:  "no ${HOST} \\n here",
+				Cert:     "-----BEGIN-----\nline\n-----END-----",
+				Tags:     []string{"a", "b"},
+				User:     "shell",
+				Fallback: "example.com",
+				// # is a value unless it is separated by a whitespace
+				Color: "#fff",
+			}))
+			Expect(metaInfo[0].Provider).To(Equal(base))
+			Expect(metaInfo[11].Provider).To(Equal(base))
+			Expect(metaInfo[1].Provider).To(Equal(local))
+			Expect(metaInfo[9].Provider).To(Equal("-"))
+
+			// process environment is not modified
+			_, ok := os.LookupEnv("HOST")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("Unterminated value should be failed", func() {
+			dir, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+			path := filepath.Join(dir, ".env")
+			Expect(ioutil.WriteFile(path, []byte("HOST=localhost\nCERT=\"line\nline\n"), 0644)).To(Succeed())
+
+			var cfg TestDotenvCfg
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			err = libConfig.NewDotenvReader(path).Read(metaInfo)
+			Expect(err).To(MatchError(path + ": line 2: unterminated quoted value"))
+		})
+
+		It("Edit after Prepare should not be read", func() {
+			dir, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+			path := filepath.Join(dir, ".env")
+			Expect(ioutil.WriteFile(path, []byte("HOST=a\nUPSTREAMS_0_HOST=b\n"), 0644)).To(Succeed())
+
+			type TestPreparedCfg struct {
+				Host      string `env:"HOST"`
+				Upstreams []struct {
+					Host string `env:"HOST"`
+				}
+			}
+			var cfg TestPreparedCfg
+			reader := editedReader{preparedReader: libConfig.NewDotenvReader(path), edit: func() {
+				Expect(ioutil.WriteFile(path, []byte("HOST=c\nUPSTREAMS_0_HOST=d\nUPSTREAMS_1_HOST=e\n"), 0644)).To(Succeed())
+			}}
+			_, err = libConfig.NewConfigService(0).ReadAndValidate(&cfg, reader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Host).To(Equal("a"))
+			Expect(cfg.Upstreams).To(HaveLen(1))
+			Expect(cfg.Upstreams[0].Host).To(Equal("b"))
+		})
+	})
+
+	Context("DirectoryReader", func() {
+		type TestDirCfg struct {
+			Host     string `dir:"host"`
+			Password string `dir:"password" data-not-logging:"true"`
+			Port     int
+			Level    string `dir:"level" data-default:"info"`
+		}
+
+		It("Volume test should be Ok", func() {
+			volume, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(volume)
+			}()
+			secrets := filepath.Join(volume, "secrets")
+			configMap := filepath.Join(volume, "config")
+			writeVolume(configMap, "..2021_01_01", map[string]string{"host": "localhost\n", "PORT": "80\n"})
+			Expect(os.Mkdir(secrets, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(secrets, "password"), []byte("s3cret\n"), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(secrets, "host"), []byte("secret-host"), 0600)).To(Succeed())
+
+			var cfg TestDirCfg
+			reader := libConfig.NewDirectoryReader(configMap, secrets, filepath.Join(volume, "missing"))
+			reader.DeriveNames = true
+			reader.TrimNewline = true
+			service := libConfig.NewConfigService(0)
+			service.Debounce = time.Millisecond
+			service.Watch = true
+			_, err = service.Start(&cfg, nil, reader)
+			defer func() {
+				_ = service.Stop()
+			}()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg).To(Equal(TestDirCfg{Host: "secret-host", Password: "s3cret", Port: 80, Level: "info"}))
+
+			var current TestDirCfg
+			metaInfo, err := libConfig.ReadStructMetadata(&current)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Read(metaInfo)).To(Succeed())
+			Expect(metaInfo[0].Provider).To(Equal(filepath.Join(secrets, "host")))
+			Expect(metaInfo[2].Provider).To(Equal(filepath.Join(configMap, "PORT")))
+
+			// "..data" symlink swap triggers refresh, new keys are read as well
+			writeVolume(configMap, "..2021_01_02", map[string]string{"host": "localhost", "PORT": "8080", "level": "debug"})
+			Eventually(func() TestDirCfg {
+				return *service.Store().Load().(*TestDirCfg)
+			}).Should(Equal(TestDirCfg{Host: "secret-host", Password: "s3cret", Port: 8080, Level: "debug"}))
+		})
+
+		It("Volume update after Prepare should not be read", func() {
+			volume, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(volume)
+			}()
+			configMap := filepath.Join(volume, "config")
+			writeVolume(configMap, "..2021_01_01", map[string]string{"host": "a", "UPSTREAMS_0_HOST": "b"})
+
+			type TestPreparedCfg struct {
+				Host      string `dir:"host"`
+				Upstreams []struct {
+					Host string `dir:"HOST"`
+				}
+			}
+			var cfg TestPreparedCfg
+			reader := editedReader{preparedReader: libConfig.NewDirectoryReader(configMap), edit: func() {
+				writeVolume(configMap, "..2021_01_02", map[string]string{"host": "c", "UPSTREAMS_0_HOST": "d", "UPSTREAMS_1_HOST": "e"})
+			}}
+			_, err = libConfig.NewConfigService(0).ReadAndValidate(&cfg, reader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Host).To(Equal("a"))
+			Expect(cfg.Upstreams).To(HaveLen(1))
+			Expect(cfg.Upstreams[0].Host).To(Equal("b"))
+		})
+	})
+
+	Context("Nested structures", func() {
+		type Upstream struct {
+			Host   string            `env:"HOST" file:"host"`
+			Port   int               `env:"PORT" file:"port" data-default:"80"`
+			Labels map[string]string `file:"labels"`
+		}
+		type Server struct {
+			Port int `env:"SERVER_PORT" file:"server.port"`
+		}
+		type Metrics struct {
+			Port int `env:"METRICS_PORT" file:"metrics.port"`
+		}
+		type TestNestedCfg struct {
+			Server
+			Metrics   *Metrics
+			Tracing   *Metrics    `env-prefix:"TRACING_"`
+			Upstreams []Upstream  `file:"upstreams"`
+			Backups   []*Upstream `env-prefix:"BACKUP_"`
+		}
+
+		It("Env test should be Ok", func() {
+			defer os.Clearenv()
+			setEnv(map[string]string{
+				"SERVER_PORT":      "8080",
+				"METRICS_PORT":     "9090",
+				"UPSTREAMS_0_HOST": "a",
+				"UPSTREAMS_0_PORT": "81",
+				"UPSTREAMS_1_HOST": "b",
+				"BACKUP_0_HOST":    "c",
+			})
+
+			var cfg TestNestedCfg
+			service := libConfig.NewConfigService(0)
+			valid, err := service.ReadAndValidate(&cfg, libConfig.NewEnvReader())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(valid).To(BeTrue())
+
+			Expect(cfg.Server.Port).To(Equal(8080))
+			Expect(cfg.Metrics).To(Equal(&Metrics{Port: 9090}))
+			// nothing is set, so the pointer is not allocated
+			Expect(cfg.Tracing).To(BeNil())
+			Expect(cfg.Upstreams).To(Equal([]Upstream{{Host: "a", Port: 81}, {Host: "b", Port: 80}}))
+			Expect(cfg.Backups).To(Equal([]*Upstream{{Host: "c", Port: 80}}))
+
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			paths := make([]string, len(metaInfo))
+			for i, meta := range metaInfo {
+				paths[i] = meta.Path
+			}
+			Expect(paths).To(Equal([]string{
+				"Port", "Metrics.Port", "Tracing.Port",
+				"Upstreams[0].Host", "Upstreams[0].Port", "Upstreams[0].Labels",
+				"Upstreams[1].Host", "Upstreams[1].Port", "Upstreams[1].Labels",
+				"Backups[0].Host", "Backups[0].Port", "Backups[0].Labels",
+			}))
+		})
+
+		It("Direct read should allocate pointers", func() {
+			defer os.Clearenv()
+			// the zero value is set explicitly
+			setEnv(map[string]string{"METRICS_PORT": "0"})
+
+			var cfg TestNestedCfg
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(libConfig.NewEnvReader().Read(metaInfo)).To(Succeed())
+			Expect(cfg.Metrics).To(Equal(&Metrics{Port: 0}))
+			Expect(cfg.Tracing).To(BeNil())
+		})
+
+		It("File test should be Ok", func() {
+			dir, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+			path := filepath.Join(dir, "config.yaml")
+			Expect(ioutil.WriteFile(path, []byte(`
+server:
+  port: 8080
+upstreams:
+  - host: a
+    labels:
+      zone: x
+  - host: b
+    port: 81
+`), 0644)).To(Succeed())
+
+			cfg := TestNestedCfg{Upstreams: []Upstream{{Host: "old"}, {Host: "old"}, {Host: "old"}}}
+			service := libConfig.NewConfigService(0)
+			changes := make([]libConfig.Change, 0)
+			service.Subscribe(func(c []libConfig.Change) {
+				changes = append(changes, c...)
+			})
+			_, err = service.ReadAndValidate(&cfg, libConfig.NewFileReader(path))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(cfg.Server.Port).To(Equal(8080))
+			Expect(cfg.Metrics).To(BeNil())
+			Expect(cfg.Upstreams).To(Equal([]Upstream{
+				{Host: "a", Port: 80, Labels: map[string]string{"zone": "x"}},
+				{Host: "b", Port: 81},
+			}))
+
+			// list shrinking is reported by paths of the removed items
+			Expect(ioutil.WriteFile(path, []byte("upstreams: [{host: a, labels: {zone: x}}]"), 0644)).To(Succeed())
+			_, _ = service.ReadAndValidate(&cfg, libConfig.NewFileReader(path))
+			Expect(cfg.Upstreams).To(HaveLen(1))
+			Expect(changes).To(ConsistOf(
+				libConfig.Change{Field: "Upstreams[1].Host", OldValue: "b", NewValue: nil},
+				libConfig.Change{Field: "Upstreams[1].Port", OldValue: 81, NewValue: nil},
+				libConfig.Change{Field: "Upstreams[1].Labels", OldValue: map[string]string(nil), NewValue: nil},
+			))
+		})
+	})
+
+	Context("FlagReader", func() {
+		It("Flags test should be Ok", func() {
+			type TestFlagCfg struct {
+				Port     int           `flag:"port" data-description:"listen port" data-default:"80"`
+				Debug    bool          `flag:"debug"`
+				Hosts    []string      `flag:"host" data-separator:"|"`
+				Timeout  time.Duration `flag:"timeout" data-default:"5s"`
+				Password string        `flag:"password" data-default:"secret" data-not-logging:"true"`
+			}
+
+			flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+			// repeated scalar flag is overridden by the last one
+			reader := libConfig.NewFlagReader(flagSet, []string{"-port", "80", "-port", "8080", "-debug", "-host", "a", "-host", "b|c"})
+
+			var cfg TestFlagCfg
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Read(metaInfo)).To(Succeed())
+
+			Expect(cfg).To(Equal(TestFlagCfg{
+				Port:  8080,
+				Debug: true,
+				Hosts: []string{"a", "b", "c"},
+			}))
+			providers := make([]string, len(metaInfo))
+			for i, meta := range metaInfo {
+				providers[i] = meta.Provider
+			}
+			Expect(providers).To(Equal([]string{"flag", "flag", "flag", "-", "-"}))
+
+			Expect(flagSet.Lookup("port").Usage).To(Equal("listen port"))
+			Expect(flagSet.Lookup("port").DefValue).To(Equal("80"))
+			Expect(flagSet.Lookup("password").DefValue).To(BeEmpty())
+
+			// flags are parsed once, so the next read gives the same result
+			Expect(reader.Read(metaInfo)).To(Succeed())
+			Expect(cfg.Port).To(Equal(8080))
+		})
+
+		It("Registered flags test should be Ok", func() {
+			type TestFlagCfg struct {
+				Port    int  `flag:"port"`
+				Verbose bool `flag:"v"`
+			}
+
+			flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+			// flags registered by the application are read as well
+			port := flagSet.Int("port", 80, "listen port")
+			flagSet.Bool("v", false, "verbose")
+			reader := libConfig.NewFlagReader(flagSet, []string{"-port", "8080"})
+
+			var cfg TestFlagCfg
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Read(metaInfo)).To(Succeed())
+			Expect(cfg).To(Equal(TestFlagCfg{Port: 8080}))
+			Expect(*port).To(Equal(8080))
+			Expect(metaInfo[1].Provider).To(Equal("-"))
+		})
+	})
+
+	Context("Direct read", func() {
+		It("Successful read should return nil error", func() {
+			defer os.Clearenv()
+			setEnv(map[string]string{"HOST": "env"})
+
+			dir, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+			Expect(ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"host": "file"}`), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, ".env"), []byte("HOST=dotenv\n"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "host"), []byte("dir"), 0644)).To(Succeed())
+
+			type TestCfg struct {
+				Host string `env:"HOST" file:"host" dir:"host" flag:"host"`
+			}
+			readers := []libConfig.Reader{
+				libConfig.NewEnvReader(),
+				libConfig.NewFileReader(filepath.Join(dir, "config.json")),
+				libConfig.NewDotenvReader(filepath.Join(dir, ".env")),
+				libConfig.NewDirectoryReader(dir),
+				libConfig.NewFlagReader(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-host", "flag"}),
+			}
+			for _, reader := range readers {
+				var cfg TestCfg
+				metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+				Expect(err).NotTo(HaveOccurred())
+				// the error must be untyped nil, not nil *multierror.Error wrapped into the interface
+				err = reader.Read(metaInfo)
+				Expect(err == nil).To(BeTrue(), "%T returned %#v", reader, err)
+				Expect(cfg.Host).NotTo(BeEmpty())
+			}
+		})
 	})
 
 	Context("NewConfigService", func() {
 		It("Should be failed", func() {
 			type TestCfg struct {
-				Var1 int `env:"TEST_VAR1"`
-				Var2 int `env:"TEST_VAR2"`
+				Var1 int `env:"TEST_VAR1" data-required:"true"`
+				Var2 int `env:"TEST_VAR2" data-required:"true"`
 				Var3 int `env:"TEST_VAR3"`
 			}
 			var cfg TestCfg
@@ -174,6 +844,271 @@ var _ = Describe("Config", func() {
 			}()
 			Expect(err).To(HaveOccurred())
 		})
+		It("Errors should be typed", func() {
+			defer os.Clearenv()
+			setEnv(map[string]string{
+				"TEST_PORT":     "port",
+				"TEST_PASSWORD": "secret",
+				"TEST_TIMEOUT":  "1",
+				"TEST_LEVEL":    "trace",
+			})
+
+			type TestErrorsCfg struct {
+				Host     string        `env:"TEST_HOST" data-required:"true"`
+				Port     int           `env:"TEST_PORT"`
+				Password int           `env:"TEST_PASSWORD" data-not-logging:"true"`
+				Timeout  time.Duration `env:"TEST_TIMEOUT"`
+				Level    string        `env:"TEST_LEVEL" validate:"oneof=debug info"`
+			}
+
+			var cfg TestErrorsCfg
+			service := libConfig.NewConfigService(0)
+			service.Validator = validatorFunc(validator.New().Struct)
+			valid, err := service.ReadAndValidate(&cfg, libConfig.NewEnvReader())
+			Expect(valid).To(BeFalse())
+
+			var cfgErr *libConfig.ConfigError
+			Expect(errors.As(err, &cfgErr)).To(BeTrue())
+			Expect(cfgErr.Errors).To(HaveLen(5))
+			Expect(*cfgErr.Errors[0]).To(MatchFields(IgnoreExtras, Fields{
+				"Field":    Equal("Port"),
+				"Provider": Equal("env"),
+				"Key":      Equal("TEST_PORT"),
+				"Value":    Equal("port"),
+				"Category": Equal(libConfig.ErrorParse),
+			}))
+			Expect(cfgErr.Errors[1].Value).To(Equal("**********"))
+			Expect(cfgErr.Errors[2].Field).To(Equal("Timeout"))
+			// required fields are reported once after all the readers
+			Expect(*cfgErr.Errors[3]).To(MatchFields(IgnoreExtras, Fields{
+				"Field":    Equal("Host"),
+				"Category": Equal(libConfig.ErrorMissing),
+			}))
+			Expect(cfgErr.ByCategory(libConfig.ErrorMissing)).To(HaveLen(1))
+			Expect(*cfgErr.Errors[4]).To(MatchFields(IgnoreExtras, Fields{
+				"Field":    Equal("Level"),
+				"Provider": Equal("env"),
+				"Value":    Equal("trace"),
+				"Category": Equal(libConfig.ErrorValidation),
+			}))
+			Expect(cfgErr.ByCategory(libConfig.ErrorParse)).To(HaveLen(3))
+			Expect(err.Error()).To(HavePrefix("5 errors occurred: Port: "))
+		})
+		It("Reader errors should be typed", func() {
+			dir, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+			invalid := filepath.Join(dir, "invalid.json")
+			Expect(ioutil.WriteFile(invalid, []byte("{"), 0644)).To(Succeed())
+			missing := filepath.Join(dir, "missing.json")
+
+			type TestReaderErrorsCfg struct {
+				Host string `file:"host"`
+			}
+
+			var cfg TestReaderErrorsCfg
+			service := libConfig.NewConfigService(0)
+			_, err = service.ReadAndValidate(&cfg, libConfig.NewFileReader(invalid), libConfig.NewFileReader(missing))
+
+			var cfgErr *libConfig.ConfigError
+			Expect(errors.As(err, &cfgErr)).To(BeTrue())
+			Expect(cfgErr.Errors).To(HaveLen(2))
+			Expect(*cfgErr.Errors[0]).To(MatchFields(IgnoreExtras, Fields{
+				"Field":    BeEmpty(),
+				"Provider": Equal(invalid),
+				"Category": Equal(libConfig.ErrorParse),
+			}))
+			Expect(*cfgErr.Errors[1]).To(MatchFields(IgnoreExtras, Fields{
+				"Field":    BeEmpty(),
+				"Provider": Equal(missing),
+				"Category": Equal(libConfig.ErrorTransport),
+			}))
+		})
+		It("Required fields and strict mode", func() {
+			defer os.Clearenv()
+			setEnv(map[string]string{"TEST_HOST": "localhost"})
+
+			type TestRequiredCfg struct {
+				Host    string `env:"TEST_HOST" data-required:"true"`
+				Port    int    `env:"TEST_PORT" data-required:"true" data-default:"80"`
+				Token   string `env:"TEST_TOKEN" data-required:"true"`
+				Comment string `env:"TEST_COMMENT"`
+			}
+
+			// optional field without value is not reported even in verbose mode
+			libConfig.Verbose = true
+			defer func() {
+				libConfig.Verbose = false
+			}()
+			var cfg TestRequiredCfg
+			service := libConfig.NewConfigService(0)
+			valid, err := service.ReadAndValidate(&cfg, libConfig.NewEnvReader(), libConfig.NewDotenvReader("missing.env"))
+			Expect(valid).To(BeFalse())
+			Expect(err).To(MatchError("1 errors occurred: required fields are not set by any of the readers: Token"))
+			Expect(cfg).To(Equal(TestRequiredCfg{}))
+
+			setEnv(map[string]string{"TEST_TOKEN": "token"})
+			valid, err = service.ReadAndValidate(&cfg, libConfig.NewEnvReader())
+			Expect(valid).To(BeTrue())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg).To(Equal(TestRequiredCfg{Host: "localhost", Port: 80, Token: "token"}))
+
+			// strict mode makes all the fields without default required
+			service.Strict = true
+			valid, err = service.ReadAndValidate(&cfg, libConfig.NewEnvReader())
+			Expect(valid).To(BeFalse())
+			Expect(err).To(MatchError("1 errors occurred: required fields are not set by any of the readers: Comment"))
+
+			// missing fields are reported by a single error
+			Expect(os.Unsetenv("TEST_TOKEN")).To(Succeed())
+			valid, err = service.ReadAndValidate(&cfg, libConfig.NewEnvReader())
+			Expect(valid).To(BeFalse())
+			Expect(err).To(MatchError("2 errors occurred: required fields are not set by any of the readers: Token, Comment"))
+			missing := err.(*libConfig.ConfigError).ByCategory(libConfig.ErrorMissing)
+			Expect(missing).To(HaveLen(2))
+			Expect(missing[0].Field).To(Equal("Token"))
+			Expect(missing[1].Field).To(Equal("Comment"))
+
+			// untagged fields are not required in strict mode
+			var updated updatedCfg
+			valid, err = service.ReadAndValidate(&updated, libConfig.NewEnvReader())
+			Expect(valid).To(BeTrue())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated).To(Equal(updatedCfg{Host: "localhost", Derived: "derived"}))
+		})
+		It("Precedence and merge", func() {
+			defer os.Clearenv()
+			setEnv(map[string]string{
+				"TEST_LEVEL":    "debug",
+				"TEST_PASSWORD": "env",
+				"TEST_HOSTS":    "c",
+				"TEST_LABELS":   "zone:y,env:prod",
+			})
+			dir, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+			path := filepath.Join(dir, "config.yaml")
+			Expect(ioutil.WriteFile(path, []byte(`
+level: info
+password: file
+hosts: [a, b]
+labels:
+  zone: x
+`), 0644)).To(Succeed())
+
+			type TestPrecedenceCfg struct {
+				Level    string            `env:"TEST_LEVEL" file:"level"`
+				Password string            `env:"TEST_PASSWORD" file:"password" data-providers:"file,vault"`
+				Hosts    []string          `env:"TEST_HOSTS" file:"hosts" data-merge:"true"`
+				Labels   map[string]string `env:"TEST_LABELS" file:"labels" data-merge:"true"`
+			}
+
+			var cfg TestPrecedenceCfg
+			service := libConfig.NewConfigService(0)
+			valid, err := service.ReadAndValidate(&cfg, libConfig.NewFileReader(path), libConfig.NewEnvReader())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(valid).To(BeTrue())
+			Expect(cfg).To(Equal(TestPrecedenceCfg{
+				Level:    "debug",
+				Password: "file",
+				Hosts:    []string{"a", "b", "c"},
+				Labels:   map[string]string{"zone": "y", "env": "prod"},
+			}))
+
+			// merged values are not accumulated by refreshes, the former reader keeps the merged map entries,
+			// winning providers are collected by the last reader
+			service.Precedence = libConfig.FirstWins
+			metaInfo := make([]libConfig.StructMeta, 0)
+			valid, err = service.ReadAndValidate(&cfg, libConfig.NewFileReader(path), libConfig.NewEnvReader(),
+				readerFunc(func(metas []libConfig.StructMeta) error {
+					metaInfo = append(metaInfo, metas...)
+					return nil
+				}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(valid).To(BeTrue())
+			Expect(cfg).To(Equal(TestPrecedenceCfg{
+				Level:    "info",
+				Password: "file",
+				Hosts:    []string{"a", "b", "c"},
+				Labels:   map[string]string{"zone": "x", "env": "prod"},
+			}))
+			providers := make(map[string]string)
+			for _, meta := range metaInfo {
+				providers[meta.Path] = meta.Provider
+			}
+			Expect(providers).To(Equal(map[string]string{
+				"Level":    path,
+				"Password": path,
+				"Hosts":    "env",
+				"Labels":   "env",
+			}))
+		})
+		It("Structured logger", func() {
+			defer os.Clearenv()
+			setEnv(map[string]string{"TEST_HOST": "localhost", "TEST_PASSWORD": "s3cret"})
+
+			type TestLoggerCfg struct {
+				Host     string `env:"TEST_HOST"`
+				Password string `env:"TEST_PASSWORD" data-not-logging:"true"`
+				Port     int    `env:"TEST_PORT"`
+			}
+
+			serviceLogger, readerLogger := &recordLogger{}, &recordLogger{}
+			reader := libConfig.NewEnvReader()
+			reader.Logger = readerLogger
+
+			var cfg TestLoggerCfg
+			service := libConfig.NewConfigService(0)
+			service.Logger = serviceLogger
+			_, err := service.ReadAndValidate(&cfg, reader)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(serviceLogger.messages("reader started")).To(HaveLen(1))
+			Expect(serviceLogger.messages("reader finished")).To(HaveLen(1))
+			Expect(serviceLogger.messages("field resolved")).To(ConsistOf(
+				logEntry{Level: "debug", Msg: "field resolved", Fields: map[string]interface{}{
+					"field": "Host", "value": "localhost", "provider": "env",
+				}},
+				logEntry{Level: "debug", Msg: "field resolved", Fields: map[string]interface{}{
+					"field": "Password", "value": "**********", "provider": "env",
+				}},
+				logEntry{Level: "debug", Msg: "field resolved", Fields: map[string]interface{}{
+					"field": "Port", "value": "0", "provider": "-",
+				}},
+			))
+			Expect(readerLogger.messages("variable is not set")).To(Equal([]logEntry{
+				{Level: "debug", Msg: "variable is not set", Fields: map[string]interface{}{"key": "TEST_PORT"}},
+			}))
+
+			// standard logger skips messages below the level
+			var buf bytes.Buffer
+			logger := libConfig.NewStdLogger(log.New(&buf, "", 0), libConfig.LevelInfo)
+			logger.Debug("skipped")
+			logger.Warn("refresh failed", "valid", false, "error", errors.New("1 errors occurred"))
+			Expect(buf.String()).To(Equal("WARN refresh failed valid=false error=\"1 errors occurred\"\n"))
+
+			// values are not formatted if debug messages are skipped
+			type TestLazyCfg struct {
+				Host formattedValue `env:"TEST_HOST"`
+			}
+			var lazyCfg TestLazyCfg
+			formattedBefore := formattedCount()
+			service.Logger = libConfig.NewStdLogger(log.New(ioutil.Discard, "", 0), libConfig.LevelDebug)
+			_, err = service.ReadAndValidate(&lazyCfg, libConfig.NewEnvReader())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(formattedCount()).To(BeNumerically(">", formattedBefore))
+
+			formattedBefore = formattedCount()
+			service.Logger = logger
+			_, err = service.ReadAndValidate(&lazyCfg, libConfig.NewEnvReader())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lazyCfg.Host).To(Equal(formattedValue("localhost")))
+			Expect(formattedCount()).To(Equal(formattedBefore))
+		})
 		It("Read and refresh", func() {
 			defer os.Clearenv()
 
@@ -211,13 +1146,1472 @@ var _ = Describe("Config", func() {
 				"TEST_VAR3": "1",
 			}
 			setEnv(vars)
-			time.Sleep(7 * time.Millisecond)
 			expected = TestCfg{
 				Var1: 3,
 				Var2: 2,
 				Var3: 1,
 			}
-			Expect(cfg).To(Equal(expected))
+			Eventually(func() TestCfg {
+				return *service.Store().Load().(*TestCfg)
+			}).Should(Equal(expected))
+			// the provided config is populated by the initial read only, so it can be read concurrently
+			Expect(cfg).To(Equal(TestCfg{Var1: 1, Var2: 2, Var3: 3}))
+		})
+
+		It("Concurrent read", func() {
+			defer os.Clearenv()
+
+			setEnv(map[string]string{"TEST_VAR1": "1", "TEST_LIST": "1,2"})
+
+			type TestCfg struct {
+				Var1 int    `env:"TEST_VAR1"`
+				List []int  `env:"TEST_LIST"`
+				Ptr  *int64 `env:"TEST_VAR1"`
+			}
+			var cfg TestCfg
+			service := libConfig.NewConfigService(time.Millisecond)
+			reader := libConfig.NewEnvReader()
+			_, err := service.Start(&cfg, nil, reader)
+			defer func() {
+				_ = service.Stop()
+			}()
+			Expect(err).NotTo(HaveOccurred())
+
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					for deadline := time.Now().Add(20 * time.Millisecond); time.Now().Before(deadline); {
+						snapshot := service.Store().Load().(*TestCfg)
+						Expect(snapshot.Var1).To(BeNumerically(">", 0))
+						Expect(snapshot.List).To(HaveLen(2))
+						Expect(*snapshot.Ptr).To(Equal(int64(snapshot.Var1)))
+						// the provided config is not written by the refresh loop
+						Expect(cfg.Var1).To(Equal(1))
+					}
+				}()
+			}
+			setEnv(map[string]string{"TEST_VAR1": "2", "TEST_LIST": "3,4"})
+			wg.Wait()
+
+			Eventually(func() int {
+				return service.Store().Load().(*TestCfg).Var1
+			}).Should(Equal(2))
+			// the provided config is populated by the initial read only
+			Expect(cfg).To(Equal(TestCfg{Var1: 1, List: []int{1, 2}, Ptr: cfg.Ptr}))
+			Expect(*cfg.Ptr).To(Equal(int64(1)))
+		})
+
+		It("Cyclic config should be Ok", func() {
+			defer os.Clearenv()
+
+			setEnv(map[string]string{"TEST_VAR1": "1"})
+
+			type TestNode struct {
+				Name string
+				Next *TestNode
+			}
+			type TestCfg struct {
+				Var1  int `env:"TEST_VAR1"`
+				Head  *TestNode
+				Spare *TestNode
+				Nodes map[string]*TestNode
+			}
+			head := &TestNode{Name: "head"}
+			head.Next = &TestNode{Name: "tail", Next: head}
+			cfg := TestCfg{Head: head, Nodes: map[string]*TestNode{"head": head}}
+			service := libConfig.NewConfigService(0)
+			_, err := service.ReadAndValidate(&cfg, libConfig.NewEnvReader())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Var1).To(Equal(1))
+			// the cycle is copied as a cycle
+			Expect(cfg.Head).NotTo(BeIdenticalTo(head))
+			Expect(cfg.Head.Next.Next).To(BeIdenticalTo(cfg.Head))
+			Expect(cfg.Nodes["head"]).To(BeIdenticalTo(cfg.Head))
+			Expect(cfg.Spare).To(BeNil())
+		})
+
+		It("Zero value service should be Ok", func() {
+			defer os.Clearenv()
+
+			setEnv(map[string]string{"TEST_VAR1": "1"})
+
+			type TestCfg struct {
+				Var1 int `env:"TEST_VAR1"`
+			}
+			var cfg TestCfg
+			var service libConfig.Service
+			Expect(service.Store().Load()).To(BeNil())
+			valid, err := service.ReadAndValidate(&cfg, libConfig.NewEnvReader())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(valid).To(BeTrue())
+			Expect(service.Store().Load()).To(Equal(&TestCfg{Var1: 1}))
+		})
+
+		It("Keep last known good config", func() {
+			defer os.Clearenv()
+
+			setEnv(map[string]string{"TEST_VAR1": "1", "TEST_VAR2": "1"})
+
+			type TestCfg struct {
+				Var1 int `env:"TEST_VAR1"`
+				Var2 int `env:"TEST_VAR2"`
+			}
+			var cfg TestCfg
+			service := libConfig.NewConfigService(time.Millisecond)
+			service.Validator = validatorFunc(func(i interface{}) error {
+				if c := i.(*TestCfg); c.Var2 < 0 {
+					return fmt.Errorf("var2 is negative")
+				}
+				return nil
+			})
+			reader := libConfig.NewEnvReader()
+			results := make(chan bool, 100)
+			_, err := service.Start(&cfg, func(valid bool, err error) {
+				select {
+				case results <- valid:
+				default:
+				}
+			}, reader)
+			defer func() {
+				_ = service.Stop()
+			}()
+			Expect(err).NotTo(HaveOccurred())
+
+			setEnv(map[string]string{"TEST_VAR1": "2", "TEST_VAR2": "-1"})
+			Eventually(results).Should(Receive(BeFalse()))
+
+			Expect(*service.Store().Load().(*TestCfg)).To(Equal(TestCfg{Var1: 1, Var2: 1}))
+		})
+
+		It("Refresh on file change", func() {
+			dir, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+			path := filepath.Join(dir, "config.json")
+			Expect(ioutil.WriteFile(path, []byte(`{"var": 1}`), 0644)).To(Succeed())
+
+			type TestCfg struct {
+				Var int `file:"var"`
+			}
+			var cfg TestCfg
+			// interval polling is disabled, so refresh is triggered by file changes only
+			service := libConfig.NewConfigService(0)
+			service.Debounce = time.Millisecond
+			service.Watch = true
+			reader := libConfig.NewFileReader(path)
+			_, err = service.Start(&cfg, nil, reader)
+			defer func() {
+				_ = service.Stop()
+			}()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Var).To(Equal(1))
+
+			Expect(ioutil.WriteFile(path, []byte(`{"var": 2}`), 0644)).To(Succeed())
+			Eventually(func() int {
+				return service.Store().Load().(*TestCfg).Var
+			}).Should(Equal(2))
+		})
+
+		It("Closed watcher channel should stop watching", func() {
+			type TestCfg struct {
+				Var int
+			}
+			var cfg TestCfg
+			service := libConfig.NewConfigService(0)
+			service.Debounce = time.Millisecond
+			service.Watch = true
+			closed := &watchingReader{notify: make(chan struct{})}
+			reader := &watchingReader{notify: make(chan struct{})}
+			_, err := service.Start(&cfg, nil, closed, reader)
+			defer func() {
+				_ = service.Stop()
+			}()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.reads()).To(Equal(int32(1)))
+
+			// closed channel should not flood the service with changes which postpone the refresh forever
+			close(closed.notify)
+			reader.notify <- struct{}{}
+			Eventually(reader.reads).Should(Equal(int32(2)))
+			Consistently(reader.reads, 100*time.Millisecond).Should(Equal(int32(2)))
+		})
+
+		It("Watching should be opt-in", func() {
+			type TestCfg struct {
+				Var int
+			}
+			var cfg TestCfg
+			// neither interval nor watching, so there is no background refresh
+			service := libConfig.NewConfigService(0)
+			service.Debounce = time.Millisecond
+			reader := &watchingReader{notify: make(chan struct{}, 1)}
+			_, err := service.Start(&cfg, nil, reader)
+			defer func() {
+				_ = service.Stop()
+			}()
+			Expect(err).NotTo(HaveOccurred())
+
+			reader.notify <- struct{}{}
+			Consistently(reader.reads, 50*time.Millisecond).Should(Equal(int32(1)))
+		})
+
+		It("Notify about changes", func() {
+			defer os.Clearenv()
+
+			setEnv(map[string]string{"TEST_POOL_SIZE": "1", "TEST_PASSWORD": "secret", "TEST_NAME": "name"})
+
+			type TestCfg struct {
+				PoolSize int    `env:"TEST_POOL_SIZE"`
+				Password string `env:"TEST_PASSWORD" data-not-logging:"true"`
+				Name     string `env:"TEST_NAME"`
+			}
+			var cfg TestCfg
+			service := libConfig.NewConfigService(time.Millisecond)
+			var (
+				mu  sync.Mutex
+				all []libConfig.Change
+			)
+			service.Subscribe(func(changes []libConfig.Change) {
+				mu.Lock()
+				defer mu.Unlock()
+				all = append(all, changes...)
+			})
+			collected := func() []libConfig.Change {
+				mu.Lock()
+				defer mu.Unlock()
+				return append([]libConfig.Change{}, all...)
+			}
+			pool := make(chan []libConfig.Change, 100)
+			service.SubscribeField("PoolSize", func(changes []libConfig.Change) {
+				pool <- changes
+			})
+			reader := libConfig.NewEnvReader()
+			_, err := service.Start(&cfg, nil, reader)
+			defer func() {
+				_ = service.Stop()
+			}()
+			Expect(err).NotTo(HaveOccurred())
+			Consistently(collected, 10*time.Millisecond).Should(BeEmpty())
+
+			setEnv(map[string]string{"TEST_POOL_SIZE": "2", "TEST_PASSWORD": "changed"})
+			Eventually(collected).Should(ConsistOf(
+				libConfig.Change{Field: "PoolSize", OldValue: 1, NewValue: 2},
+				libConfig.Change{Field: "Password", OldValue: "**********", NewValue: "**********"},
+			))
+			Eventually(pool).Should(Receive(Equal([]libConfig.Change{
+				{Field: "PoolSize", OldValue: 1, NewValue: 2},
+			})))
+		})
+
+		It("Stop during refresh", func() {
+			type TestCfg struct {
+				Var1 int `env:"TEST_VAR1"`
+			}
+			var cfg TestCfg
+			service := libConfig.NewConfigService(time.Millisecond)
+			reader := &blockingReader{}
+			_, err := service.Start(&cfg, nil, reader)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() int32 {
+				return atomic.LoadInt32(&reader.calls)
+			}).Should(BeNumerically(">", 1))
+
+			stopped := make(chan struct{})
+			go func() {
+				_ = service.Stop()
+				// second call should not block
+				_ = service.Stop()
+				close(stopped)
+			}()
+			Eventually(stopped).Should(BeClosed())
+			Expect(atomic.LoadInt32(&reader.stopped)).To(Equal(int32(1)))
+		})
+
+		It("Stop without refresh loop should stop readers", func() {
+			type TestCfg struct {
+				Var1 int `env:"TEST_VAR1"`
+			}
+			var cfg TestCfg
+			// neither interval nor watching, so the readers are stopped by Stop itself
+			service := libConfig.NewConfigService(0)
+			reader := &blockingReader{}
+			_, err := service.Start(&cfg, nil, reader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(atomic.LoadInt32(&reader.stopped)).To(Equal(int32(0)))
+			Expect(service.Stop()).To(Succeed())
+			Expect(atomic.LoadInt32(&reader.stopped)).To(Equal(int32(1)))
+		})
+
+		It("Stop by context", func() {
+			type TestCfg struct {
+				Var1 int `env:"TEST_VAR1"`
+			}
+			var cfg TestCfg
+			ctx, cancel := context.WithCancel(context.Background())
+			service := libConfig.NewConfigService(time.Millisecond)
+			reader := &blockingReader{}
+			_, err := service.StartContext(ctx, &cfg, nil, reader)
+			Expect(err).NotTo(HaveOccurred())
+			cancel()
+			Eventually(func() int32 {
+				return atomic.LoadInt32(&reader.stopped)
+			}).Should(Equal(int32(1)))
+			Expect(service.Stop()).To(Succeed())
+		})
+	})
+
+	Context("ConsulReader", func() {
+		type TestConsulCfg struct {
+			Host    string        `consul:"app/host"`
+			Port    int           `consul:"app/port"`
+			Timeout time.Duration `consul:"timeout"`
+			Debug   bool          `consul:"app/debug"`
+		}
+
+		It("KV test should be Ok", func() {
+			stub := newConsulStub(map[string]string{
+				"config/app/host": "localhost",
+				"config/app/port": "8080",
+				"config/timeout":  "5s",
+				"other/app/host":  "other",
+			})
+			defer stub.Close()
+
+			reader := libConfig.NewConsulReader(stub.URL, "config/")
+			reader.Token = "token"
+			reader.WaitTime = time.Second
+
+			var cfg TestConsulCfg
+			service := libConfig.NewConfigService(0)
+			service.Debounce = time.Millisecond
+			service.Watch = true
+			_, err := service.Start(&cfg, nil, reader)
+			defer func() {
+				_ = service.Stop()
+			}()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg).To(Equal(TestConsulCfg{Host: "localhost", Port: 8080, Timeout: 5 * time.Second}))
+			// keys are read by a single request of the prefix
+			Expect(stub.readPaths()).To(Equal([]string{"/v1/kv/config/"}))
+
+			// blocking query triggers refresh
+			stub.put("config/app/debug", "true")
+			Eventually(func() bool {
+				return service.Store().Load().(*TestConsulCfg).Debug
+			}).Should(BeTrue())
+		})
+
+		It("Batches test should be Ok", func() {
+			stub := newConsulStub(map[string]string{
+				"apps/billing/prod/app/host": "localhost",
+				"apps/billing/prod/timeout":  "5s",
+				"apps/billing/dev/timeout":   "1s",
+				"apps/shop/db/host":          "db",
+				"apps/shop/port":             "8080",
+			})
+			defer stub.Close()
+
+			// prefix is requested as a single batch
+			reader := libConfig.NewConsulReader(stub.URL, "apps/billing/prod")
+			reader.Token = "token"
+			var cfg TestConsulCfg
+			service := libConfig.NewConfigService(0)
+			_, err := service.ReadAndValidate(&cfg, reader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg).To(Equal(TestConsulCfg{Host: "localhost", Timeout: 5 * time.Second}))
+			Expect(stub.readPaths()).To(Equal([]string{"/v1/kv/apps/billing/prod/"}))
+
+			// keys without prefix are batched by the parent path
+			type TestConsulPathsCfg struct {
+				DBHost string `consul:"apps/shop/db/host"`
+				Port   int    `consul:"apps/shop/port"`
+			}
+			reader = libConfig.NewConsulReader(stub.URL, "")
+			reader.Token = "token"
+			var pathsCfg TestConsulPathsCfg
+			_, err = service.ReadAndValidate(&pathsCfg, reader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pathsCfg).To(Equal(TestConsulPathsCfg{DBHost: "db", Port: 8080}))
+			Expect(stub.readPaths()[1:]).To(ConsistOf("/v1/kv/apps/shop/db/", "/v1/kv/apps/shop/"))
+		})
+
+		It("Client timeout should not limit blocking query", func() {
+			stub := newConsulStub(map[string]string{"config/app/host": "localhost"})
+			defer stub.Close()
+
+			reader := libConfig.NewConsulReader(stub.URL, "config/")
+			reader.Token = "token"
+			reader.WaitTime = 5 * time.Second
+			reader.Client = &http.Client{Timeout: 100 * time.Millisecond}
+
+			var cfg TestConsulCfg
+			service := libConfig.NewConfigService(0)
+			service.Debounce = time.Millisecond
+			service.Watch = true
+			_, err := service.Start(&cfg, nil, reader)
+			defer func() {
+				_ = service.Stop()
+			}()
+			Expect(err).NotTo(HaveOccurred())
+
+			// the change after the client timeout is seen by the same blocking query
+			time.Sleep(300 * time.Millisecond)
+			stub.put("config/app/debug", "true")
+			Eventually(func() bool {
+				return service.Store().Load().(*TestConsulCfg).Debug
+			}).Should(BeTrue())
+		})
+
+		It("Blocking query without index should not spin", func() {
+			stub := newConsulStub(map[string]string{"config/app/host": "localhost"})
+			defer stub.Close()
+			stub.noIndex = true
+
+			reader := libConfig.NewConsulReader(stub.URL, "config/")
+			reader.Token = "token"
+			defer reader.Stop()
+			var cfg TestConsulCfg
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Read(metaInfo)).To(Succeed())
+
+			// queries return immediately, so they are rate limited and don't notify about changes
+			notify, err := reader.Watch()
+			Expect(err).NotTo(HaveOccurred())
+			Consistently(notify, 500*time.Millisecond).ShouldNot(Receive())
+			Expect(stub.requestsCount()).To(BeNumerically("<=", 2))
+		})
+
+		It("Denied request should be failed", func() {
+			stub := newConsulStub(map[string]string{"app/host": "localhost"})
+			defer stub.Close()
+
+			// a request per batch: "app/" and "timeout"
+			var cfg TestConsulCfg
+			service := libConfig.NewConfigService(0)
+			_, err := service.ReadAndValidate(&cfg, libConfig.NewConsulReader(stub.URL, ""))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*libConfig.ConfigError).ByCategory(libConfig.ErrorAuth)).To(HaveLen(2))
+		})
+	})
+
+	Context("EtcdReader", func() {
+		type TestEtcdCfg struct {
+			Host    string `etcd:"db/host"`
+			Port    int    `etcd:"db/port"`
+			Feature bool   `etcd:"features/beta"`
+		}
+
+		It("Range and watch test should be Ok", func() {
+			stub := newEtcdStub(map[string]string{
+				"/app/db/host":   "localhost",
+				"/app/db/port":   "5432",
+				"/app/db/user":   "user",
+				"/other/db/host": "other",
+			})
+			defer stub.Close()
+
+			reader := libConfig.NewEtcdReader(stub.URL, "/app/")
+			reader.Username = "root"
+			reader.Password = "pass"
+
+			var cfg TestEtcdCfg
+			service := libConfig.NewConfigService(0)
+			service.Debounce = time.Millisecond
+			service.Watch = true
+			_, err := service.Start(&cfg, nil, reader)
+			defer func() {
+				_ = service.Stop()
+			}()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg).To(Equal(TestEtcdCfg{Host: "localhost", Port: 5432}))
+			Expect(stub.readRequests()).To(Equal(1))
+
+			// keys out of the prefix are not watched
+			stub.put("/other/db/host", "changed")
+			Consistently(stub.readRequests, 100*time.Millisecond).Should(Equal(1))
+
+			// watch event triggers refresh
+			stub.put("/app/features/beta", "true")
+			Eventually(func() bool {
+				return service.Store().Load().(*TestEtcdCfg).Feature
+			}).Should(BeTrue())
+			Expect(stub.readRequests()).To(Equal(2))
+		})
+
+		It("Client timeout should not limit watch stream", func() {
+			stub := newEtcdStub(map[string]string{"/app/db/host": "localhost"})
+			defer stub.Close()
+
+			reader := libConfig.NewEtcdReader(stub.URL, "/app/")
+			reader.Username = "root"
+			reader.Password = "pass"
+			reader.Client = &http.Client{Timeout: 100 * time.Millisecond}
+
+			var cfg TestEtcdCfg
+			service := libConfig.NewConfigService(0)
+			service.Debounce = time.Millisecond
+			service.Watch = true
+			_, err := service.Start(&cfg, nil, reader)
+			defer func() {
+				_ = service.Stop()
+			}()
+			Expect(err).NotTo(HaveOccurred())
+
+			// the change after the client timeout is seen by the same watch stream
+			time.Sleep(300 * time.Millisecond)
+			stub.put("/app/features/beta", "true")
+			Eventually(func() bool {
+				return service.Store().Load().(*TestEtcdCfg).Feature
+			}).Should(BeTrue())
+		})
+
+		It("Keys without prefix test should be Ok", func() {
+			stub := newEtcdStub(map[string]string{
+				"/app/db/host": "localhost",
+				"/app/db/port": "5432",
+			})
+			defer stub.Close()
+
+			type TestEtcdKeysCfg struct {
+				Host    string `etcd:"/app/db/host"`
+				Port    int    `etcd:"/app/db/port"`
+				Feature bool   `etcd:"/app/features/beta"`
+			}
+			reader := libConfig.NewEtcdReader(stub.URL, "")
+			reader.Username = "root"
+			reader.Password = "pass"
+
+			var cfg TestEtcdKeysCfg
+			service := libConfig.NewConfigService(0)
+			service.Debounce = time.Millisecond
+			service.Watch = true
+			_, err := service.Start(&cfg, nil, reader)
+			defer func() {
+				_ = service.Stop()
+			}()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg).To(Equal(TestEtcdKeysCfg{Host: "localhost", Port: 5432}))
+			Expect(stub.readRequests()).To(Equal(1))
+
+			// only the tagged keys are watched, even if the key is between them
+			stub.put("/app/db/user", "user")
+			Consistently(stub.readRequests, 100*time.Millisecond).Should(Equal(1))
+
+			stub.put("/app/features/beta", "true")
+			Eventually(func() bool {
+				return service.Store().Load().(*TestEtcdKeysCfg).Feature
+			}).Should(BeTrue())
+			Expect(stub.readRequests()).To(Equal(2))
+		})
+
+		It("Denied request should be failed", func() {
+			stub := newEtcdStub(map[string]string{})
+			defer stub.Close()
+
+			var cfg TestEtcdCfg
+			reader := libConfig.NewEtcdReader(stub.URL, "/app/")
+			reader.Username = "root"
+			service := libConfig.NewConfigService(0)
+			_, err := service.ReadAndValidate(&cfg, reader)
+			Expect(err).To(MatchError("1 errors occurred: etcd authentication: 401 Unauthorized"))
+			Expect(err.(*libConfig.ConfigError).ByCategory(libConfig.ErrorAuth)).To(HaveLen(1))
+		})
+	})
+
+	Context("AWS", func() {
+		It("SSM parameters test should be Ok", func() {
+			stub := newAWSStub()
+			defer stub.Close()
+			stub.handle("AmazonSSM.GetParametersByPath", func(body map[string]interface{}) (int, interface{}) {
+				Expect(body).To(HaveKeyWithValue("Path", "/app/prod"))
+				Expect(body).To(HaveKeyWithValue("WithDecryption", true))
+				// the second page
+				if body["NextToken"] == "next" {
+					return http.StatusOK, map[string]interface{}{"Parameters": []map[string]string{
+						{"Name": "/app/prod/db/password", "Type": "SecureString", "Value": "s3cret"},
+					}}
+				}
+				return http.StatusOK, map[string]interface{}{
+					"Parameters": []map[string]string{
+						{"Name": "/app/prod/db/host", "Type": "String", "Value": "localhost"},
+						{"Name": "/app/prod/hosts", "Type": "StringList", "Value": "a,b"},
+					},
+					"NextToken": "next",
+				}
+			})
+			stub.handle("AmazonSSM.GetParameters", func(body map[string]interface{}) (int, interface{}) {
+				Expect(body["Names"]).To(ConsistOf("host", "port"))
+				return http.StatusOK, map[string]interface{}{
+					"Parameters":        []map[string]string{{"Name": "host", "Type": "String", "Value": "example.com"}},
+					"InvalidParameters": []string{"port"},
+				}
+			})
+
+			type TestSSMCfg struct {
+				Host     string   `ssm:"db/host"`
+				Password string   `ssm:"db/password" data-not-logging:"true"`
+				Hosts    []string `ssm:"hosts"`
+				Port     int      `ssm:"db/port"`
+			}
+			var cfg TestSSMCfg
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(libConfig.NewSSMReader(stub.session(), "/app/prod").Read(metaInfo)).To(Succeed())
+			Expect(cfg).To(Equal(TestSSMCfg{Host: "localhost", Password: "s3cret", Hosts: []string{"a", "b"}}))
+			Expect(metaInfo[0].Provider).To(Equal("ssm"))
+			Expect(stub.callsOf("AmazonSSM.GetParametersByPath")).To(Equal(2))
+
+			// parameters are read by names without path
+			type TestSSMNamesCfg struct {
+				Host string `ssm:"host"`
+				Port int    `ssm:"port"`
+			}
+			var namesCfg TestSSMNamesCfg
+			metaInfo, err = libConfig.ReadStructMetadata(&namesCfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(libConfig.NewSSMReader(stub.session(), "").Read(metaInfo)).To(Succeed())
+			Expect(namesCfg).To(Equal(TestSSMNamesCfg{Host: "example.com"}))
+		})
+
+		It("Secrets Manager test should be Ok", func() {
+			stub := newAWSStub()
+			defer stub.Close()
+			stub.handle("secretsmanager.GetSecretValue", func(body map[string]interface{}) (int, interface{}) {
+				switch body["SecretId"].(string) + "@" + body["VersionStage"].(string) {
+				case "app/db@AWSCURRENT":
+					return http.StatusOK, map[string]string{"SecretString": `{"user": "app", "password": "new", "pool": {"size": 10}}`}
+				case "app/db@AWSPREVIOUS":
+					return http.StatusOK, map[string]string{"SecretString": `{"password": "old"}`}
+				case "app/db@prod@AWSCURRENT":
+					return http.StatusOK, map[string]string{"SecretString": `{"user": "prod"}`}
+				case "app/db@blue":
+					return http.StatusOK, map[string]string{"SecretString": `{"password": "blue"}`}
+				case "arn:aws:secretsmanager:us-east-1:123:secret:app/token-abc@AWSCURRENT":
+					return http.StatusOK, map[string]string{"SecretString": "token"}
+				case "app/denied@AWSCURRENT":
+					return http.StatusBadRequest, map[string]string{"__type": "AccessDeniedException", "message": "denied"}
+				}
+				return http.StatusBadRequest, map[string]string{"__type": "ResourceNotFoundException", "message": "not found"}
+			})
+
+			type TestSecretsCfg struct {
+				User        string `secretsmanager:"app/db:user"`
+				Password    string `secretsmanager:"app/db:password"`
+				OldPassword string `secretsmanager:"app/db:password@AWSPREVIOUS"`
+				BluePass    string `secretsmanager:"app/db:password@stage=blue"`
+				ProdUser    string `secretsmanager:"app/db@prod:user"`
+				PoolSize    int    `secretsmanager:"app/db:pool.size"`
+				Token       string `secretsmanager:"arn:aws:secretsmanager:us-east-1:123:secret:app/token-abc"`
+				Missing     string `secretsmanager:"app/missing:key"`
+				MissingToo  string `secretsmanager:"app/missing:other"`
+				Denied      string `secretsmanager:"app/denied:key"`
+				DeniedToo   string `secretsmanager:"app/denied:other"`
+			}
+			var cfg TestSecretsCfg
+			service := libConfig.NewConfigService(0)
+			_, err := service.ReadAndValidate(&cfg, libConfig.NewSecretsManagerReader(stub.session()))
+			Expect(cfg).To(Equal(TestSecretsCfg{
+				User: "app", Password: "new", OldPassword: "old", BluePass: "blue", ProdUser: "prod", PoolSize: 10, Token: "token",
+			}))
+			// secret is read once per refresh even if it is failed, missing secret is not reported
+			Expect(stub.callsOf("secretsmanager.GetSecretValue")).To(Equal(7))
+			Expect(err).To(HaveOccurred())
+			cfgErr := err.(*libConfig.ConfigError)
+			Expect(cfgErr.Errors).To(HaveLen(2))
+			Expect(cfgErr.Errors[0].Field).To(Equal("Denied"))
+			Expect(cfgErr.Errors[1].Field).To(Equal("DeniedToo"))
+			Expect(cfgErr.ByCategory(libConfig.ErrorAuth)).To(HaveLen(2))
+		})
+	})
+
+	Context("HTTPReader", func() {
+		It("Conditional request test should be Ok", func() {
+			var (
+				mu       sync.Mutex
+				document = `{"db": {"host": "localhost", "port": 5432}, "upstreams": [{"host": "a"}, {"host": "b"}], "a/b": {"c~d": "pointer"}}`
+				status   = http.StatusOK
+				parsed   int
+				requests int
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				requests++
+				Expect(r.Header.Get("Authorization")).To(Equal("Bearer token"))
+				Expect(r.Header.Get("X-Env")).To(Equal("prod"))
+				if status != http.StatusOK {
+					w.WriteHeader(status)
+					return
+				}
+				etag := fmt.Sprintf(`"%x"`, len(document))
+				if r.Header.Get("If-None-Match") == etag {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				parsed++
+				w.Header().Set("ETag", etag)
+				_, _ = w.Write([]byte(document))
+			}))
+			defer server.Close()
+			update := func(doc string, code int) {
+				mu.Lock()
+				defer mu.Unlock()
+				document, status = doc, code
+			}
+
+			type TestHTTPCfg struct {
+				Host      string `http:"db.host"`
+				Port      int    `http:"/db/port"`
+				Pointer   string `http:"/a~1b/c~0d"`
+				Upstreams []struct {
+					Host string `http:"host"`
+				} `http:"upstreams"`
+			}
+			reader := libConfig.NewHTTPReader(server.URL + "/config")
+			reader.BearerToken = "token"
+			reader.Header = http.Header{"X-Env": []string{"prod"}}
+			read := func() (TestHTTPCfg, error) {
+				var cfg TestHTTPCfg
+				_, err := libConfig.NewConfigService(0).ReadAndValidate(&cfg, reader)
+				return cfg, err
+			}
+
+			cfg, err := read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Host).To(Equal("localhost"))
+			Expect(cfg.Port).To(Equal(5432))
+			Expect(cfg.Pointer).To(Equal("pointer"))
+			Expect(cfg.Upstreams).To(HaveLen(2))
+			Expect(cfg.Upstreams[1].Host).To(Equal("b"))
+			// the list size and the fields are read from the same document
+			Expect(requests).To(Equal(1))
+
+			// unchanged document is not sent again
+			cfg, err = read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Host).To(Equal("localhost"))
+			Expect(parsed).To(Equal(1))
+
+			// the last good document is used on transport failures
+			update(`{"db": {"host": "example.com"}}`, http.StatusBadGateway)
+			cfg, err = read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Host).To(Equal("localhost"))
+
+			update(`{"db": {"host": "example.com"}}`, http.StatusOK)
+			cfg, err = read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Host).To(Equal("example.com"))
+			Expect(cfg.Upstreams).To(BeEmpty())
+
+			// auth failures are reported
+			update(`{}`, http.StatusForbidden)
+			_, err = read()
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*libConfig.ConfigError).ByCategory(libConfig.ErrorAuth)).To(HaveLen(1))
+		})
+
+		It("Cancelled refresh should not hang", func() {
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-release:
+				case <-r.Context().Done():
+				}
+			}))
+			defer server.Close()
+			defer close(release)
+
+			type TestHTTPCfg struct {
+				Upstreams []struct {
+					Host string `http:"host"`
+				} `http:"upstreams"`
+			}
+			var cfg TestHTTPCfg
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := libConfig.NewConfigService(0).ReadAndValidateContext(ctx, &cfg, libConfig.NewHTTPReader(server.URL))
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+		})
+	})
+
+	Context("Vault", func() {
+		It("AppRole auth should be Ok", func() {
+			stub := newVaultStub()
+			defer stub.Close()
+
+			tokenTTL := 50 * time.Millisecond
+			stub.handle("GET /v1/auth/token/lookup-self", func(r *http.Request, _ map[string]interface{}) (int, interface{}) {
+				status, data := vaultTokenData(r.Header.Get("X-Vault-Token"), time.Hour)
+				data.(map[string]interface{})["data"].(map[string]interface{})["expire_time"] = time.Now().Add(tokenTTL).Format(time.RFC3339Nano)
+				return status, data
+			})
+			stub.handle("PUT /v1/sys/wrapping/unwrap", func(r *http.Request, _ map[string]interface{}) (int, interface{}) {
+				if r.Header.Get("X-Vault-Token") != "wrapping-token" {
+					return http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}}
+				}
+				return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"secret_id": "secret-id"}}
+			})
+			stub.handle("PUT /v1/auth/approle/login", func(_ *http.Request, body map[string]interface{}) (int, interface{}) {
+				if body["role_id"] != "role-id" || body["secret_id"] != "secret-id" {
+					return http.StatusBadRequest, map[string]interface{}{"errors": []string{"invalid credentials"}}
+				}
+				return vaultLoginData("approle-token")
+			})
+			stub.handle("GET /v1/secret/app", func(r *http.Request, _ map[string]interface{}) (int, interface{}) {
+				if r.Header.Get("X-Vault-Token") != "approle-token" {
+					return http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}}
+				}
+				return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"data": map[string]interface{}{"password": "pass"}}}
+			})
+
+			vaultConfig := libConfig.NewVaultApiConfig(stub.URL, false)
+			auth, err := libConfig.NewVaultAppRoleAuth("approle", "role-id", libConfig.AppRoleSecretIDFromWrappedToken("wrapping-token"), vaultConfig)
+			Expect(err).NotTo(HaveOccurred())
+			vault, err := libConfig.NewStorageVault(auth, "data")
+			Expect(err).NotTo(HaveOccurred())
+			reader := libConfig.NewVaultReader(vault)
+			defer reader.Stop()
+
+			type TestCfg struct {
+				Password string `vault:"secret/app:password"`
+			}
+			var cfg TestCfg
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Read(metaInfo)).To(Succeed())
+			Expect(cfg.Password).To(Equal("pass"))
+			Expect(stub.callsOf("PUT /v1/auth/approle/login")).To(Equal(1))
+
+			// token has been expired, so the next read logs in again with the unwrapped secret_id
+			time.Sleep(2 * tokenTTL)
+			Expect(reader.Read(metaInfo)).To(Succeed())
+			Expect(stub.callsOf("PUT /v1/auth/approle/login")).To(Equal(2))
+			Expect(stub.callsOf("PUT /v1/sys/wrapping/unwrap")).To(Equal(1))
+			// mount is not detected, so KV v1 is assumed without repeating the detection
+			Expect(stub.callsOf("GET /v1/sys/internal/ui/mounts/secret/app")).To(Equal(1))
+		})
+
+		It("Cert auth should be Ok", func() {
+			stub := newVaultTLSStub()
+			defer stub.Close()
+
+			stub.handle("PUT /v1/auth/cert/login", func(r *http.Request, body map[string]interface{}) (int, interface{}) {
+				if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "client" {
+					return http.StatusBadRequest, map[string]interface{}{"errors": []string{"invalid certificate"}}
+				}
+				if body["name"] != "web" {
+					return http.StatusBadRequest, map[string]interface{}{"errors": []string{"invalid role"}}
+				}
+				return vaultLoginData("cert-token")
+			})
+
+			dir, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+			certPath, keyPath := writeClientCert(dir)
+
+			vaultConfig, err := libConfig.NewVaultApiConfigWithTLS(stub.URL, false, &api.TLSConfig{
+				ClientCert: certPath,
+				ClientKey:  keyPath,
+				Insecure:   true,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			auth, err := libConfig.NewVaultCertAuth("cert", "web", vaultConfig)
+			Expect(err).NotTo(HaveOccurred())
+			defer auth.Stop()
+
+			Expect(auth.Authenticate()).To(Succeed())
+			Expect(auth.GetClient().Token()).To(Equal("cert-token"))
+		})
+
+		It("JWT auth should re-read token file", func() {
+			stub := newVaultStub()
+			defer stub.Close()
+
+			var jwts []interface{}
+			stub.handle("GET /v1/auth/token/lookup-self", func(r *http.Request, _ map[string]interface{}) (int, interface{}) {
+				status, data := vaultTokenData(r.Header.Get("X-Vault-Token"), time.Hour)
+				// token is expired immediately
+				data.(map[string]interface{})["data"].(map[string]interface{})["expire_time"] = time.Now().Format(time.RFC3339Nano)
+				return status, data
+			})
+			stub.handle("PUT /v1/auth/ci/login", func(_ *http.Request, body map[string]interface{}) (int, interface{}) {
+				if body["role"] != "deploy" {
+					return http.StatusBadRequest, map[string]interface{}{"errors": []string{"invalid role"}}
+				}
+				jwts = append(jwts, body["jwt"])
+				return vaultLoginData("jwt-token")
+			})
+
+			dir, err := ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+			tokenPath := filepath.Join(dir, "token")
+			Expect(ioutil.WriteFile(tokenPath, []byte("first\n"), 0600)).To(Succeed())
+
+			vaultConfig := libConfig.NewVaultApiConfig(stub.URL, false)
+			auth, err := libConfig.NewVaultJWTAuth("ci", "deploy", libConfig.JWTFromFile(tokenPath), vaultConfig)
+			Expect(err).NotTo(HaveOccurred())
+			defer auth.Stop()
+
+			Expect(auth.Authenticate()).To(Succeed())
+			Expect(ioutil.WriteFile(tokenPath, []byte("second\n"), 0600)).To(Succeed())
+			Expect(auth.Authenticate()).To(Succeed())
+			Expect(jwts).To(Equal([]interface{}{"first", "second"}))
+		})
+
+		It("KV v2 should be detected", func() {
+			stub := newVaultStub()
+			defer stub.Close()
+
+			mount := func(path, version string) vaultHandler {
+				return func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+					return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+						"path":    path,
+						"type":    "kv",
+						"options": map[string]interface{}{"version": version},
+					}}
+				}
+			}
+			stub.handle("GET /v1/sys/internal/ui/mounts/secret/app", mount("secret/", "2"))
+			stub.handle("GET /v1/sys/internal/ui/mounts/kv/app", mount("kv/", "1"))
+			stub.handle("GET /v1/secret/data/app", func(r *http.Request, _ map[string]interface{}) (int, interface{}) {
+				version, password := 4, "current"
+				if r.URL.Query().Get("version") == "3" {
+					version, password = 3, "previous"
+				}
+				return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+					"data": map[string]interface{}{"password": password},
+					"metadata": map[string]interface{}{
+						"version":       version,
+						"created_time":  "2021-02-25T11:11:11.511Z",
+						"deletion_time": "",
+						"destroyed":     false,
+					},
+				}}
+			})
+			stub.handle("GET /v1/kv/app", func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+					"user": "admin", "admin@example": "contact", "user@0": "zero",
+				}}
+			})
+
+			vaultConfig := libConfig.NewVaultApiConfig(stub.URL, false)
+			auth, err := libConfig.NewVaultTokenAuth("token", vaultConfig)
+			Expect(err).NotTo(HaveOccurred())
+			vault, err := libConfig.NewStorageVault(auth, "")
+			Expect(err).NotTo(HaveOccurred())
+			reader := libConfig.NewVaultReader(vault)
+			defer reader.Stop()
+
+			type TestCfg struct {
+				Password         string `vault:"secret/app:password"`
+				PreviousPassword string `vault:"secret/app:password@3"`
+				User             string `vault:"kv/app:user"`
+				// @ is a part of the key unless it is followed by a positive version
+				Contact string `vault:"kv/app:admin@example"`
+				Zero    string `vault:"kv/app:user@0"`
+			}
+			var cfg TestCfg
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			err = reader.Read(metaInfo)
+			Expect(err == nil).To(BeTrue(), "untyped nil error is expected, got %#v", err)
+			Expect(cfg).To(Equal(TestCfg{
+				Password: "current", PreviousPassword: "previous", User: "admin", Contact: "contact", Zero: "zero",
+			}))
+			// mount is detected once
+			Expect(stub.callsOf("GET /v1/sys/internal/ui/mounts/secret/app")).To(Equal(1))
+
+			md, ok := vault.Metadata("secret/app")
+			Expect(ok).To(BeTrue())
+			Expect(md.Version).To(Equal(4))
+			Expect(md.CreatedTime).To(Equal(timeFunc("2021-02-25T11:11:11.511Z", time.RFC3339Nano)))
+			Expect(md.Deleted()).To(BeFalse())
+			// pinned version doesn't override metadata of the latest one
+			md, ok = vault.VersionMetadata("secret/app", 3)
+			Expect(ok).To(BeTrue())
+			Expect(md.Version).To(Equal(3))
+
+			// KV v2 is detected with the data key as well, the path includes data segment
+			stub.handle("GET /v1/sys/internal/ui/mounts/secret/data/app", mount("secret/", "2"))
+			dataVault, err := libConfig.NewStorageVault(auth, "data")
+			Expect(err).NotTo(HaveOccurred())
+			type TestDataCfg struct {
+				Password         string `vault:"secret/data/app:password"`
+				PreviousPassword string `vault:"secret/data/app:password@3"`
+			}
+			var dataCfg TestDataCfg
+			metaInfo, err = libConfig.ReadStructMetadata(&dataCfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(libConfig.NewVaultReader(dataVault).Read(metaInfo)).To(Succeed())
+			Expect(dataCfg).To(Equal(TestDataCfg{Password: "current", PreviousPassword: "previous"}))
+			md, ok = dataVault.Metadata("secret/data/app")
+			Expect(ok).To(BeTrue())
+			Expect(md.Version).To(Equal(4))
+		})
+
+		It("Data key should be applied to KV v2 only", func() {
+			stub := newVaultStub()
+			defer stub.Close()
+
+			stub.handle("GET /v1/sys/internal/ui/mounts/database/creds/app", func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"path": "database/", "type": "database"}}
+			})
+			stub.handle("GET /v1/database/creds/app", func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"username": "user"}}
+			})
+			// mount of the legacy path can not be detected, so the data key is kept
+			stub.handle("GET /v1/legacy/app", func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+					"data": map[string]interface{}{"host": "localhost"},
+				}}
+			})
+
+			vaultConfig := libConfig.NewVaultApiConfig(stub.URL, false)
+			auth, err := libConfig.NewVaultTokenAuth("token", vaultConfig)
+			Expect(err).NotTo(HaveOccurred())
+			vault, err := libConfig.NewStorageVault(auth, "data")
+			Expect(err).NotTo(HaveOccurred())
+			reader := libConfig.NewVaultReader(vault)
+			defer reader.Stop()
+
+			type TestCfg struct {
+				User string `vault:"database/creds/app:username"`
+				Host string `vault:"legacy/app:host"`
+			}
+			var cfg TestCfg
+			metaInfo, err := libConfig.ReadStructMetadata(&cfg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Read(metaInfo)).To(Succeed())
+			Expect(cfg).To(Equal(TestCfg{User: "user", Host: "localhost"}))
+		})
+
+		It("Pinned version on KV v1 should be failed", func() {
+			stub := newVaultStub()
+			defer stub.Close()
+
+			stub.handle("GET /v1/sys/internal/ui/mounts/kv/app", func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+					"path": "kv/", "type": "kv", "options": map[string]interface{}{"version": "1"},
+				}}
+			})
+			stub.handle("GET /v1/kv/app", func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"user": "admin"}}
+			})
+
+			vaultConfig := libConfig.NewVaultApiConfig(stub.URL, false)
+			auth, err := libConfig.NewVaultTokenAuth("token", vaultConfig)
+			Expect(err).NotTo(HaveOccurred())
+			vault, err := libConfig.NewStorageVault(auth, "")
+			Expect(err).NotTo(HaveOccurred())
+			reader := libConfig.NewVaultReader(vault)
+			defer reader.Stop()
+
+			type TestCfg struct {
+				User    string `vault:"kv/app:user"`
+				Port    int    `vault:"kv/app:port@3"`
+				Missing string `vault:"kv/app:missing"`
+				Absent  string `vault:"kv/absent:key"`
+			}
+			var cfg TestCfg
+			service := libConfig.NewConfigService(0)
+			_, err = service.ReadAndValidate(&cfg, reader)
+			Expect(cfg).To(Equal(TestCfg{User: "admin"}))
+
+			// missing key and secret are not reported, version pinning failure is
+			var cfgErr *libConfig.ConfigError
+			Expect(errors.As(err, &cfgErr)).To(BeTrue())
+			Expect(cfgErr.Errors).To(HaveLen(1))
+			Expect(*cfgErr.Errors[0]).To(MatchFields(IgnoreExtras, Fields{
+				"Field":    Equal("Port"),
+				"Category": Equal(libConfig.ErrorParse),
+			}))
+			Expect(cfgErr.Errors[0].Err).To(MatchError(ContainSubstring("version pinning is supported by KV v2 only")))
+		})
+
+		It("Non-string values should be Ok", func() {
+			stub := newVaultStub()
+			defer stub.Close()
+
+			stub.handle("GET /v1/kv/app", func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+					"port": 8080, "debug": true, "hosts": []string{"a", "b"}, "security_token": nil,
+				}}
+			})
+
+			vaultConfig := libConfig.NewVaultApiConfig(stub.URL, false)
+			auth, err := libConfig.NewVaultTokenAuth("token", vaultConfig)
+			Expect(err).NotTo(HaveOccurred())
+			vault, err := libConfig.NewStorageVault(auth, "")
+			Expect(err).NotTo(HaveOccurred())
+			reader := libConfig.NewVaultReader(vault)
+			defer reader.Stop()
+
+			type TestCfg struct {
+				Port  int      `vault:"kv/app:port"`
+				Debug bool     `vault:"kv/app:debug"`
+				Hosts []string `vault:"kv/app:hosts"`
+				Token string   `vault:"kv/app:security_token" data-default:"none"`
+			}
+			var cfg TestCfg
+			service := libConfig.NewConfigService(0)
+			valid, err := service.ReadAndValidate(&cfg, reader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(valid).To(BeTrue())
+			// null value is not set, so the default is kept
+			Expect(cfg).To(Equal(TestCfg{Port: 8080, Debug: true, Hosts: []string{"a", "b"}, Token: "none"}))
+		})
+
+		It("Dynamic secret lease should be tracked", func() {
+			stub := newVaultStub()
+			defer stub.Close()
+
+			var (
+				mu      sync.Mutex
+				issued  int
+				revoked []interface{}
+			)
+			stub.handle("GET /v1/sys/internal/ui/mounts/database/creds/app", func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"path": "database/", "type": "database"}}
+			})
+			stub.handle("GET /v1/database/creds/app", func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+				issued++
+				return http.StatusOK, map[string]interface{}{
+					"lease_id":       fmt.Sprintf("database/creds/app/%d", issued),
+					"lease_duration": 1,
+					"renewable":      true,
+					"data":           map[string]interface{}{"username": fmt.Sprintf("user%d", issued)},
+				}
+			})
+			stub.handle("PUT /v1/sys/leases/renew", func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+				return http.StatusBadRequest, map[string]interface{}{"errors": []string{"lease not found"}}
+			})
+			stub.handle("PUT /v1/sys/leases/revoke", func(_ *http.Request, body map[string]interface{}) (int, interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+				revoked = append(revoked, body["lease_id"])
+				return http.StatusNoContent, nil
+			})
+
+			vaultConfig := libConfig.NewVaultApiConfig(stub.URL, false)
+			auth, err := libConfig.NewVaultTokenAuth("token", vaultConfig)
+			Expect(err).NotTo(HaveOccurred())
+			vault, err := libConfig.NewStorageVault(auth, "")
+			Expect(err).NotTo(HaveOccurred())
+			reader := libConfig.NewVaultReader(vault)
+
+			type TestCfg struct {
+				User string `vault:"database/creds/app:username"`
+			}
+			var cfg TestCfg
+			// interval polling and watching are disabled, so refresh is triggered by the lease expiration only
+			service := libConfig.NewConfigService(0)
+			service.Debounce = time.Millisecond
+			_, err = service.Start(&cfg, nil, reader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.User).To(Equal("user1"))
+
+			Eventually(func() string {
+				return service.Store().Load().(*TestCfg).User
+			}, 3*time.Second).Should(Equal("user2"))
+
+			Expect(service.Stop()).To(Succeed())
+			mu.Lock()
+			defer mu.Unlock()
+			// the replaced lease is revoked once the config with the new secret is published, the last one is revoked on stop
+			Expect(revoked).To(Equal([]interface{}{"database/creds/app/1", "database/creds/app/2"}))
+		})
+
+		It("Leases should be revoked on Stop without refresh loop", func() {
+			stub := newVaultStub()
+			defer stub.Close()
+
+			var (
+				mu      sync.Mutex
+				revoked []interface{}
+			)
+			stub.handle("GET /v1/sys/internal/ui/mounts/database/creds/app", func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"path": "database/", "type": "database"}}
+			})
+			stub.handle("GET /v1/database/creds/app", func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, map[string]interface{}{
+					"lease_id":       "database/creds/app/1",
+					"lease_duration": 3600,
+					"renewable":      true,
+					"data":           map[string]interface{}{"username": "user"},
+				}
+			})
+			stub.handle("PUT /v1/sys/leases/revoke", func(_ *http.Request, body map[string]interface{}) (int, interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+				revoked = append(revoked, body["lease_id"])
+				return http.StatusNoContent, nil
+			})
+
+			vaultConfig := libConfig.NewVaultApiConfig(stub.URL, false)
+			auth, err := libConfig.NewVaultTokenAuth("token", vaultConfig)
+			Expect(err).NotTo(HaveOccurred())
+			vault, err := libConfig.NewStorageVault(auth, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			type TestCfg struct {
+				User string `vault:"database/creds/app:username"`
+			}
+			var cfg TestCfg
+			service := libConfig.NewConfigService(0)
+			_, err = service.Start(&cfg, nil, libConfig.NewVaultReader(vault))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.User).To(Equal("user"))
+
+			Expect(service.Stop()).To(Succeed())
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(revoked).To(Equal([]interface{}{"database/creds/app/1"}))
+		})
+
+		It("Replaced lease should be kept until the config is published", func() {
+			stub := newVaultStub()
+			defer stub.Close()
+
+			var (
+				mu      sync.Mutex
+				issued  int
+				revoked []interface{}
+			)
+			stub.handle("GET /v1/sys/internal/ui/mounts/database/creds/app", func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+				return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"path": "database/", "type": "database"}}
+			})
+			stub.handle("GET /v1/database/creds/app", func(_ *http.Request, _ map[string]interface{}) (int, interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+				issued++
+				return http.StatusOK, map[string]interface{}{
+					"lease_id":       fmt.Sprintf("database/creds/app/%d", issued),
+					"lease_duration": 1,
+					"renewable":      false,
+					"data":           map[string]interface{}{"username": fmt.Sprintf("user%d", issued)},
+				}
+			})
+			stub.handle("PUT /v1/sys/leases/revoke", func(_ *http.Request, body map[string]interface{}) (int, interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+				revoked = append(revoked, body["lease_id"])
+				return http.StatusNoContent, nil
+			})
+			revokedLeases := func() []interface{} {
+				mu.Lock()
+				defer mu.Unlock()
+				return append([]interface{}(nil), revoked...)
+			}
+
+			vaultConfig := libConfig.NewVaultApiConfig(stub.URL, false)
+			auth, err := libConfig.NewVaultTokenAuth("token", vaultConfig)
+			Expect(err).NotTo(HaveOccurred())
+			vault, err := libConfig.NewStorageVault(auth, "")
+			Expect(err).NotTo(HaveOccurred())
+			reader := libConfig.NewVaultReader(vault)
+
+			type TestCfg struct {
+				User string `vault:"database/creds/app:username"`
+			}
+			var cfg TestCfg
+			service := libConfig.NewConfigService(0)
+			service.Debounce = time.Millisecond
+			// the second secret is invalid, so the config with the first one is kept
+			service.Validator = validatorFunc(func(i interface{}) error {
+				if i.(*TestCfg).User == "user2" {
+					return errors.New("invalid user")
+				}
+				return nil
+			})
+			results := make(chan bool, 10)
+			_, err = service.Start(&cfg, func(valid bool, _ error) {
+				results <- valid
+			}, reader)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(results, 3*time.Second).Should(Receive(BeFalse()))
+			Expect(service.Store().Load().(*TestCfg).User).To(Equal("user1"))
+			// the lease of the published secret is not revoked by the invalid refresh
+			Expect(revokedLeases()).To(BeEmpty())
+
+			Eventually(results, 3*time.Second).Should(Receive(BeTrue()))
+			Expect(service.Store().Load().(*TestCfg).User).To(Equal("user3"))
+			Eventually(revokedLeases).Should(ConsistOf("database/creds/app/1", "database/creds/app/2"))
+
+			Expect(service.Stop()).To(Succeed())
+			Expect(revokedLeases()).To(ConsistOf("database/creds/app/1", "database/creds/app/2", "database/creds/app/3"))
+		})
+	})
+
+	Context("Generator", func() {
+		type TestDocCfg struct {
+			Port     int               `env:"PORT" flag:"port" data-default:"8080" data-description:"listen port" data-required:"true"`
+			Hosts    []string          `env:"HOSTS" data-default:"a,b"`
+			Limits   map[string]int    `file:"limits" data-default:"x:1"`
+			Timeout  time.Duration     `env:"TIMEOUT" data-default:"5s"`
+			Password string            `env:"PASSWORD" data-default:"secret" data-not-logging:"true" data-description:"db password"`
+			Labels   map[string]string `env:"LABELS"`
+		}
+
+		var fields []libConfig.FieldDoc
+		BeforeEach(func() {
+			var err error
+			fields, err = libConfig.DescribeFields(&TestDocCfg{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Markdown should mask secret defaults", func() {
+			var buf bytes.Buffer
+			Expect(libConfig.Generate(&buf, libConfig.FormatMarkdown, "app", fields)).To(Succeed())
+			Expect(buf.String()).To(ContainSubstring("| Port | `int` | env: `PORT`<br>flag: `port` | `8080` | listen port |"))
+			Expect(buf.String()).To(ContainSubstring("| Password | `string` | env: `PASSWORD` | `**********` | db password |"))
+			Expect(buf.String()).NotTo(ContainSubstring("secret"))
+		})
+
+		It("Env example should be Ok", func() {
+			var buf bytes.Buffer
+			Expect(libConfig.Generate(&buf, libConfig.FormatEnv, "app", fields)).To(Succeed())
+			Expect(buf.String()).To(Equal("# listen port\nPORT=8080\nHOSTS=a,b\nTIMEOUT=5s\n# db password\nPASSWORD=\nLABELS=\n"))
+		})
+
+		It("Kubernetes skeleton should split secrets", func() {
+			var buf bytes.Buffer
+			Expect(libConfig.Generate(&buf, libConfig.FormatKubernetes, "app", fields)).To(Succeed())
+			documents := strings.Split(buf.String(), "\n---\n")
+			Expect(documents).To(HaveLen(2))
+
+			var configMap, secret struct {
+				Kind       string
+				Data       map[string]string
+				StringData map[string]string `yaml:"stringData"`
+			}
+			Expect(yaml.Unmarshal([]byte(documents[0]), &configMap)).To(Succeed())
+			Expect(yaml.Unmarshal([]byte(documents[1]), &secret)).To(Succeed())
+			Expect(configMap.Kind).To(Equal("ConfigMap"))
+			Expect(configMap.Data).To(Equal(map[string]string{"PORT": "8080", "HOSTS": "a,b", "TIMEOUT": "5s", "LABELS": ""}))
+			Expect(secret.Kind).To(Equal("Secret"))
+			Expect(secret.StringData).To(Equal(map[string]string{"PASSWORD": ""}))
+		})
+
+		It("JSON Schema should be Ok", func() {
+			var buf bytes.Buffer
+			Expect(libConfig.Generate(&buf, libConfig.FormatJSONSchema, "app", fields)).To(Succeed())
+
+			var schema map[string]interface{}
+			Expect(json.Unmarshal(buf.Bytes(), &schema)).To(Succeed())
+			Expect(schema["title"]).To(Equal("app"))
+			Expect(schema["required"]).To(Equal([]interface{}{"Port"}))
+			properties := schema["properties"].(map[string]interface{})
+			Expect(properties["Port"]).To(Equal(map[string]interface{}{
+				"type": "integer", "description": "listen port", "default": float64(8080),
+			}))
+			Expect(properties["Hosts"]).To(Equal(map[string]interface{}{
+				"type": "array", "items": map[string]interface{}{"type": "string"}, "default": []interface{}{"a", "b"},
+			}))
+			Expect(properties["Limits"]).To(Equal(map[string]interface{}{
+				"type": "object", "additionalProperties": map[string]interface{}{"type": "integer"},
+				"default": map[string]interface{}{"x": float64(1)},
+			}))
+			Expect(properties["Timeout"]).To(Equal(map[string]interface{}{
+				"type": "string", "format": "duration", "default": "5s",
+			}))
+			Expect(properties["Password"]).To(Equal(map[string]interface{}{
+				"type": "string", "description": "db password", "writeOnly": true,
+			}))
+		})
+
+		It("Env example with reader options should be Ok", func() {
+			fields, err := libConfig.DescribeFields(&TestDocCfg{}, libConfig.DescribeOptions{EnvPrefix: "APP_", DeriveNames: true})
+			Expect(err).NotTo(HaveOccurred())
+			var buf bytes.Buffer
+			Expect(libConfig.Generate(&buf, libConfig.FormatEnv, "app", fields)).To(Succeed())
+			// the field of the file reader is not derived
+			Expect(buf.String()).To(Equal("# listen port\nAPP_PORT=8080\nAPP_HOSTS=a,b\nAPP_TIMEOUT=5s\n# db password\nAPP_PASSWORD=\nAPP_LABELS=\n"))
+		})
+
+		It("JSON Schema with non-finite default should be Ok", func() {
+			fields, err := libConfig.DescribeFields(&struct {
+				Ratio float64 `env:"RATIO" data-default:"Inf"`
+				Scale float64 `env:"SCALE" data-default:"NaN"`
+			}{})
+			Expect(err).NotTo(HaveOccurred())
+			var buf bytes.Buffer
+			Expect(libConfig.Generate(&buf, libConfig.FormatJSONSchema, "app", fields)).To(Succeed())
+
+			var schema map[string]interface{}
+			Expect(json.Unmarshal(buf.Bytes(), &schema)).To(Succeed())
+			properties := schema["properties"].(map[string]interface{})
+			// non-finite values are not valid numbers, so the defaults are omitted
+			Expect(properties["Ratio"]).To(Equal(map[string]interface{}{"type": "number"}))
+			Expect(properties["Scale"]).To(Equal(map[string]interface{}{"type": "number"}))
+		})
+
+		It("JSON Schema of nested fields should be Ok", func() {
+			type Upstream struct {
+				Host string `file:"host" data-required:"true"`
+			}
+			fields, err := libConfig.DescribeFields(&struct {
+				DB struct {
+					Host string `file:"host" data-required:"true"`
+					Port int    `file:"port" data-default:"5432"`
+				} `file:"db"`
+				Metrics *struct {
+					Port int `file:"port"`
+				} `file:"metrics"`
+				Upstreams []Upstream `file:"upstreams"`
+			}{Upstreams: []Upstream{{}, {}}})
+			Expect(err).NotTo(HaveOccurred())
+			var buf bytes.Buffer
+			Expect(libConfig.Generate(&buf, libConfig.FormatJSONSchema, "app", fields)).To(Succeed())
+
+			var schema map[string]interface{}
+			Expect(json.Unmarshal(buf.Bytes(), &schema)).To(Succeed())
+			Expect(schema["required"]).To(ConsistOf("DB", "Upstreams"))
+			Expect(schema["properties"]).To(Equal(map[string]interface{}{
+				"DB": map[string]interface{}{
+					"type":     "object",
+					"required": []interface{}{"Host"},
+					"properties": map[string]interface{}{
+						"Host": map[string]interface{}{"type": "string"},
+						"Port": map[string]interface{}{"type": "integer", "default": float64(5432)},
+					},
+				},
+				"Metrics": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"Port": map[string]interface{}{"type": "integer"},
+					},
+				},
+				"Upstreams": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type":     "object",
+						"required": []interface{}{"Host"},
+						"properties": map[string]interface{}{
+							"Host": map[string]interface{}{"type": "string"},
+						},
+					},
+				},
+			}))
+		})
+
+		It("Unsupported format should be failed", func() {
+			Expect(libConfig.Generate(ioutil.Discard, "xml", "app", fields)).NotTo(Succeed())
 		})
 	})
 })
@@ -0,0 +1,263 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// ErrorMissing the value is not set in the source
+	ErrorMissing ErrorCategory = "missing"
+	// ErrorParse the value or the source document is invalid
+	ErrorParse ErrorCategory = "parse"
+	// ErrorValidation the config is rejected by the validator
+	ErrorValidation ErrorCategory = "validation"
+	// ErrorAuth the reader is failed to authenticate in the source
+	ErrorAuth ErrorCategory = "auth"
+	// ErrorTransport the source is not reachable
+	ErrorTransport ErrorCategory = "transport"
+)
+
+// errRequiredField is an error of the required field which is not set, such errors are summarised by ConfigError
+var errRequiredField = errors.New("required field is not set by any of the readers")
+
+type (
+	// ErrorCategory is a cause of the field error
+	ErrorCategory string
+
+	// FieldError describes a failure of the field, Field and Key of the reader errors which are not related
+	// to a field are empty
+	FieldError struct {
+		// Field is a path of the field
+		Field string
+		// Provider is a reader tag or the source (e.g. file path)
+		Provider string
+		// Key is a source key, e.g. env variable name or vault path:key
+		Key string
+		// Value is a raw value, it is masked for the data-not-logging fields
+		Value    string
+		Category ErrorCategory
+		Err      error
+	}
+
+	// ConfigError is returned by ReadAndValidate, it contains an entry per failure
+	ConfigError struct {
+		Errors []*FieldError
+	}
+
+	// categoryError marks the error by the category
+	categoryError struct {
+		category ErrorCategory
+		err      error
+	}
+
+	// namespacedError is a validation error of the field, e.g. go-playground validator FieldError
+	namespacedError interface {
+		error
+		Namespace() string
+	}
+)
+
+func (e *FieldError) Error() string {
+	if e.Field == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Error lists the errors, missing required fields are listed by a single point
+func (e *ConfigError) Error() string {
+	points := make([]string, 0, len(e.Errors))
+	var missing []string
+	// missing fields point is placed at the first missing field
+	missingAt := -1
+	for _, err := range e.Errors {
+		if errors.Is(err.Err, errRequiredField) && err.Field != "" {
+			if missingAt < 0 {
+				missingAt = len(points)
+				points = append(points, "")
+			}
+			missing = append(missing, err.Field)
+			continue
+		}
+		points = append(points, err.Error())
+	}
+	if missingAt >= 0 {
+		points[missingAt] = fmt.Sprintf("required fields are not set by any of the readers: %s", strings.Join(missing, ", "))
+	}
+
+	return fmt.Sprintf(
+		"%d errors occurred: %s",
+		len(e.Errors), strings.Join(points, ", "))
+}
+
+// ByCategory returns errors of the category
+func (e *ConfigError) ByCategory(category ErrorCategory) []*FieldError {
+	result := make([]*FieldError, 0)
+	for _, err := range e.Errors {
+		if err.Category == category {
+			result = append(result, err)
+		}
+	}
+	return result
+}
+
+// add the error of the provider, multierror lists are flattened (readers could return nil *multierror.Error),
+// errors which are not field ones are classified by their type, sources are unavailable by default
+func (e *ConfigError) add(provider string, err error) {
+	if merr, ok := err.(*multierror.Error); ok {
+		if merr == nil {
+			return
+		}
+		for _, item := range merr.Errors {
+			e.add(provider, item)
+		}
+		return
+	}
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		e.Errors = append(e.Errors, fieldErr)
+		return
+	}
+	e.Errors = append(e.Errors, &FieldError{
+		Provider: provider,
+		Category: errorCategory(err, ErrorTransport),
+		Err:      err,
+	})
+}
+
+// addValidation adds validation error, every field error of the validation errors list is added separately
+func (e *ConfigError) addValidation(err error, metas []StructMeta) {
+	items := []error{err}
+	if list := reflect.ValueOf(err); list.Kind() == reflect.Slice {
+		items = make([]error, 0, list.Len())
+		for i := 0; i < list.Len(); i++ {
+			if item, ok := list.Index(i).Interface().(error); ok {
+				items = append(items, item)
+			}
+		}
+	}
+
+	for _, item := range items {
+		fieldErr := &FieldError{Category: ErrorValidation, Err: item}
+		if nsErr, ok := item.(namespacedError); ok {
+			// namespace starts with the structure type name
+			if idx := strings.Index(nsErr.Namespace(), "."); idx >= 0 {
+				fieldErr.Field = nsErr.Namespace()[idx+1:]
+			}
+			for _, meta := range metas {
+				if meta.Path == fieldErr.Field {
+					fieldErr.Provider = meta.Provider
+					fieldErr.Value = metaValue(meta, fmt.Sprintf("%v", meta.FieldValue))
+				}
+			}
+		}
+		e.Errors = append(e.Errors, fieldErr)
+	}
+}
+
+// errorOrNil returns nil if there are no errors
+func (e *ConfigError) errorOrNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *categoryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *categoryError) Unwrap() error {
+	return e.err
+}
+
+// withCategory marks the error by the category
+func withCategory(category ErrorCategory, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &categoryError{category: category, err: err}
+}
+
+// errorCategory classifies the error, def category is returned if the error is unknown
+func errorCategory(err error, def ErrorCategory) ErrorCategory {
+	var catErr *categoryError
+	if errors.As(err, &catErr) {
+		return catErr.category
+	}
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) {
+		switch {
+		case respErr.StatusCode == http.StatusUnauthorized || respErr.StatusCode == http.StatusForbidden:
+			return ErrorAuth
+		case respErr.StatusCode >= http.StatusInternalServerError:
+			return ErrorTransport
+		}
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case secretsmanager.ErrCodeResourceNotFoundException, ssm.ErrCodeParameterNotFound:
+			return ErrorMissing
+		case request.ErrCodeRequestError, request.ErrCodeResponseTimeout:
+			return ErrorTransport
+		// AWS reports denied requests with 400 status
+		case "AccessDeniedException", "UnrecognizedClientException", "ExpiredTokenException", "InvalidSignatureException":
+			return ErrorAuth
+		}
+		if reqErr, ok := awsErr.(awserr.RequestFailure); ok {
+			switch {
+			case reqErr.StatusCode() == http.StatusUnauthorized || reqErr.StatusCode() == http.StatusForbidden:
+				return ErrorAuth
+			case reqErr.StatusCode() >= http.StatusInternalServerError:
+				return ErrorTransport
+			}
+		}
+	}
+	var (
+		urlErr  *url.Error
+		netErr  net.Error
+		pathErr *os.PathError
+	)
+	if errors.As(err, &urlErr) || errors.As(err, &netErr) || errors.As(err, &pathErr) {
+		return ErrorTransport
+	}
+	return def
+}
+
+// newFieldError makes error of the field, raw value is masked for the data-not-logging fields
+func newFieldError(meta StructMeta, provider, key, value string, category ErrorCategory, err error) *FieldError {
+	return &FieldError{
+		Field:    meta.Path,
+		Provider: provider,
+		Key:      key,
+		Value:    metaValue(meta, value),
+		Category: category,
+		Err:      err,
+	}
+}
+
+func metaValue(meta StructMeta, value string) string {
+	if meta.NotLogging && value != "" {
+		return maskedValue
+	}
+	return value
+}
@@ -0,0 +1,404 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatMarkdown   = "markdown"
+	FormatEnv        = "env"
+	FormatKubernetes = "kubernetes"
+	FormatJSONSchema = "json-schema"
+
+	jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+)
+
+type (
+	// FieldDoc describes a config field for the documentation
+	FieldDoc struct {
+		Name            string
+		Env             string
+		Type            string
+		Kind            reflect.Kind
+		ElemKind        reflect.Kind
+		Tag             reflect.StructTag
+		Default         string
+		DefaultProvided bool
+		Description     string
+		Separator       string
+		Layout          string
+		Secret          bool
+		Required        bool
+	}
+
+	// DescribeOptions are the env reader options applied to the variable names of the documentation
+	DescribeOptions struct {
+		// EnvPrefix is added to all the variable names, see EnvReader.Prefix
+		EnvPrefix string
+		// DeriveNames derives the variable names of the fields without env tag, see EnvReader.DeriveNames
+		DeriveNames bool
+	}
+
+	jsonSchema struct {
+		Schema               string                 `json:"$schema,omitempty"`
+		Title                string                 `json:"title,omitempty"`
+		Type                 string                 `json:"type,omitempty"`
+		Format               string                 `json:"format,omitempty"`
+		Description          string                 `json:"description,omitempty"`
+		Default              interface{}            `json:"default,omitempty"`
+		WriteOnly            bool                   `json:"writeOnly,omitempty"`
+		Items                *jsonSchema            `json:"items,omitempty"`
+		AdditionalProperties *jsonSchema            `json:"additionalProperties,omitempty"`
+		Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+		Required             []string               `json:"required,omitempty"`
+	}
+)
+
+// DescribeFields collects documentation of the config structure fields, options should match the env reader,
+// e.g. DescribeOptions{EnvPrefix: reader.Prefix, DeriveNames: reader.DeriveNames}
+func DescribeFields(cfg interface{}, options ...DescribeOptions) ([]FieldDoc, error) {
+	metas, err := ReadStructMetadata(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts DescribeOptions
+	if len(options) > 0 {
+		opts = options[0]
+	}
+
+	fields := make([]FieldDoc, len(metas))
+	for i, meta := range metas {
+		t := meta.FieldValue.Type()
+		fields[i] = FieldDoc{
+			Name:            meta.Path,
+			Env:             envName(meta, "env", opts.EnvPrefix, opts.DeriveNames),
+			Type:            t.String(),
+			Kind:            indirectType(t).Kind(),
+			Tag:             *meta.Tag,
+			Default:         meta.DefValue,
+			DefaultProvided: meta.DefValueProvided,
+			Description:     meta.Description,
+			Separator:       meta.Separator,
+			Layout:          meta.Layout,
+			Secret:          meta.NotLogging,
+			Required:        meta.Required,
+		}
+		if it := indirectType(t); it.Kind() == reflect.Slice || it.Kind() == reflect.Map {
+			fields[i].ElemKind = indirectType(it.Elem()).Kind()
+		}
+	}
+
+	return fields, nil
+}
+
+// Generate writes documentation of the given format, name is used as a title or kubernetes resource name
+func Generate(w io.Writer, format, name string, fields []FieldDoc) error {
+	switch format {
+	case FormatMarkdown:
+		return GenerateMarkdown(w, fields)
+	case FormatEnv:
+		return GenerateEnvExample(w, fields)
+	case FormatKubernetes:
+		return GenerateKubernetes(w, name, fields)
+	case FormatJSONSchema:
+		return GenerateJSONSchema(w, name, fields)
+	default:
+		return fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+// GenerateMarkdown writes fields as a Markdown table
+func GenerateMarkdown(w io.Writer, fields []FieldDoc) error {
+	lines := []string{
+		"| Field | Type | Sources | Default | Description |",
+		"|-------|------|---------|---------|-------------|",
+	}
+	for _, field := range fields {
+		sources := make([]string, 0)
+		for _, tag := range readerTags {
+			value := field.Tag.Get(tag)
+			if tag == "env" {
+				value = field.Env
+			}
+			if value != "" {
+				sources = append(sources, fmt.Sprintf("%s: `%s`", tag, value))
+			}
+		}
+		defValue := ""
+		if field.DefaultProvided {
+			defValue = "`" + field.displayDefault() + "`"
+		}
+		lines = append(lines, fmt.Sprintf("| %s | `%s` | %s | %s | %s |",
+			field.Name,
+			field.Type,
+			markdownEscape(strings.Join(sources, "<br>")),
+			markdownEscape(defValue),
+			markdownEscape(field.Description),
+		))
+	}
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// GenerateEnvExample writes .env.example file of the fields with env variable, secret defaults are omitted
+func GenerateEnvExample(w io.Writer, fields []FieldDoc) error {
+	lines := make([]string, 0)
+	for _, field := range fields {
+		name := field.Env
+		if name == "" {
+			continue
+		}
+		if field.Description != "" {
+			lines = append(lines, "# "+field.Description)
+		}
+		value := ""
+		if field.DefaultProvided && !field.Secret {
+			value = field.Default
+		}
+		lines = append(lines, fmt.Sprintf("%s=%s", name, envQuote(value)))
+	}
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// GenerateKubernetes writes ConfigMap with the non-secret and Secret with the secret fields with env variable
+func GenerateKubernetes(w io.Writer, name string, fields []FieldDoc) error {
+	configMap := make([]string, 0)
+	secret := make([]string, 0)
+	for _, field := range fields {
+		key := field.Env
+		if key == "" {
+			continue
+		}
+		if field.Secret {
+			secret = append(secret, fmt.Sprintf("  %s: \"\"", key))
+			continue
+		}
+		if field.Description != "" {
+			configMap = append(configMap, "  # "+field.Description)
+		}
+		configMap = append(configMap, fmt.Sprintf("  %s: %s", key, strconv.Quote(field.Default)))
+	}
+
+	documents := make([]string, 0, 2)
+	if len(configMap) > 0 {
+		documents = append(documents, strings.Join(append([]string{
+			"apiVersion: v1",
+			"kind: ConfigMap",
+			"metadata:",
+			"  name: " + name,
+			"data:",
+		}, configMap...), "\n"))
+	}
+	if len(secret) > 0 {
+		documents = append(documents, strings.Join(append([]string{
+			"apiVersion: v1",
+			"kind: Secret",
+			"metadata:",
+			"  name: " + name,
+			"type: Opaque",
+			"stringData:",
+		}, secret...), "\n"))
+	}
+
+	_, err := io.WriteString(w, strings.Join(documents, "\n---\n")+"\n")
+	return err
+}
+
+// GenerateJSONSchema writes JSON Schema of the config, secret defaults are omitted.
+// Nested fields are described by nested objects, items of the structure lists by the array items
+func GenerateJSONSchema(w io.Writer, title string, fields []FieldDoc) error {
+	schema := &jsonSchema{
+		Schema:     jsonSchemaDraft,
+		Title:      title,
+		Type:       "object",
+		Properties: make(map[string]*jsonSchema),
+	}
+	for _, field := range fields {
+		property := schemaOf(field.Kind, field.Type, field.Layout)
+		switch field.Kind {
+		case reflect.Slice:
+			if field.ElemKind == reflect.Uint8 {
+				property = &jsonSchema{Type: "string"}
+			} else {
+				property.Items = schemaOf(field.ElemKind, "", field.Layout)
+			}
+		case reflect.Map:
+			property.AdditionalProperties = schemaOf(field.ElemKind, "", field.Layout)
+		}
+		property.Description = field.Description
+		property.WriteOnly = field.Secret
+		if field.DefaultProvided && !field.Secret {
+			if value, ok := schemaDefault(field); ok {
+				property.Default = value
+			}
+		}
+
+		// parents of the required field are required as well, so the field can not be skipped with its parent
+		parent := schema
+		parts := strings.Split(field.Name, ".")
+		for _, part := range parts[:len(parts)-1] {
+			parent = parent.nested(part, field.Required)
+		}
+		name := parts[len(parts)-1]
+		parent.Properties[name] = property
+		if field.Required {
+			parent.require(name)
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(schema)
+}
+
+// nested returns the object schema of the path segment, it is created if it doesn't exist.
+// Segment of the list item, e.g. Upstreams[0], is the object of the array items
+func (s *jsonSchema) nested(segment string, required bool) *jsonSchema {
+	name, item := segment, false
+	if idx := strings.Index(segment, "["); idx >= 0 {
+		name, item = segment[:idx], true
+	}
+
+	property, ok := s.Properties[name]
+	if !ok {
+		property = &jsonSchema{Type: "object", Properties: make(map[string]*jsonSchema)}
+		if item {
+			property = &jsonSchema{Type: "array", Items: property}
+		}
+		s.Properties[name] = property
+	}
+	if required {
+		s.require(name)
+	}
+
+	if item {
+		return property.Items
+	}
+	return property
+}
+
+// require adds the property to the required ones once
+func (s *jsonSchema) require(name string) {
+	for _, r := range s.Required {
+		if r == name {
+			return
+		}
+	}
+	s.Required = append(s.Required, name)
+}
+
+// displayDefault masks secret default value
+func (f FieldDoc) displayDefault() string {
+	if f.Secret {
+		return maskedValue
+	}
+	return f.Default
+}
+
+// schemaOf maps field kind to JSON Schema type
+func schemaOf(kind reflect.Kind, typeName, layout string) *jsonSchema {
+	switch {
+	case strings.HasSuffix(typeName, "time.Duration"):
+		return &jsonSchema{Type: "string", Format: "duration"}
+	case strings.HasSuffix(typeName, "time.Time"):
+		if layout != "" {
+			return &jsonSchema{Type: "string"}
+		}
+		return &jsonSchema{Type: "string", Format: "date-time"}
+	}
+
+	switch kind {
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array"}
+	case reflect.Map, reflect.Struct:
+		return &jsonSchema{Type: "object"}
+	default:
+		return &jsonSchema{Type: "string"}
+	}
+}
+
+// schemaDefault converts raw default value to the JSON value of the field type,
+// it reports false if the value can not be represented by the type, e.g. Inf or NaN of the number
+func schemaDefault(field FieldDoc) (interface{}, bool) {
+	switch field.Kind {
+	case reflect.Slice:
+		if field.ElemKind == reflect.Uint8 {
+			return field.Default, true
+		}
+		items := make([]interface{}, 0)
+		if strings.TrimSpace(field.Default) != "" {
+			for _, item := range strings.Split(field.Default, field.Separator) {
+				value, ok := scalarDefault(field.ElemKind, item)
+				if !ok {
+					return nil, false
+				}
+				items = append(items, value)
+			}
+		}
+		return items, true
+	case reflect.Map:
+		items := make(map[string]interface{})
+		if strings.TrimSpace(field.Default) != "" {
+			for _, pair := range strings.Split(field.Default, field.Separator) {
+				if kv := strings.SplitN(pair, ":", 2); len(kv) == 2 {
+					value, ok := scalarDefault(field.ElemKind, kv[1])
+					if !ok {
+						return nil, false
+					}
+					items[kv[0]] = value
+				}
+			}
+		}
+		return items, true
+	default:
+		if strings.HasSuffix(field.Type, "time.Duration") {
+			return field.Default, true
+		}
+		return scalarDefault(field.Kind, field.Default)
+	}
+}
+
+// scalarDefault converts raw value to the JSON value of the kind,
+// json.Number is written as is, so only finite JSON numbers are valid, e.g. Inf and NaN are not
+func scalarDefault(kind reflect.Kind, raw string) (interface{}, bool) {
+	switch schemaOf(kind, "", "").Type {
+	case "boolean":
+		b, err := strconv.ParseBool(raw)
+		return b, err == nil
+	case "integer", "number":
+		if f, err := strconv.ParseFloat(raw, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) && json.Valid([]byte(raw)) {
+			return json.Number(raw), true
+		}
+		return nil, false
+	}
+	return raw, true
+}
+
+func markdownEscape(s string) string {
+	return strings.ReplaceAll(s, "|", "\\|")
+}
+
+// envQuote quotes value if it contains spaces or special characters
+func envQuote(value string) string {
+	if strings.ContainsAny(value, " \t\n\"'#$\\") {
+		return strconv.Quote(value)
+	}
+	return value
+}
@@ -3,11 +3,13 @@ module github.com/MiG-21/go-lib-config
 go 1.15
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/aws/aws-sdk-go v1.39.1
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-playground/validator/v10 v10.5.0
 	github.com/hashicorp/go-multierror v1.1.0
 	github.com/hashicorp/vault/api v1.1.0
 	github.com/onsi/ginkgo v1.16.0
 	github.com/onsi/gomega v1.11.0
-	github.com/pkg/errors v0.9.1
+	gopkg.in/yaml.v2 v2.4.0
 )
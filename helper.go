@@ -1,26 +1,31 @@
 package config
 
 import (
+	"crypto/tls"
+	"flag"
 	"net/http"
+	"os"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/hashicorp/vault/api"
 )
 
 func NewVaultTokenAuth(token string, vaultConfig *api.Config) (*VaultTokenAuth, error) {
-	vaultClient, err := api.NewClient(vaultConfig)
+	vaultClient, err := newVaultClient(token, vaultConfig)
 	if err != nil {
 		return nil, err
 	}
-	vaultClient.SetToken(token)
 	return &VaultTokenAuth{
 		Client: vaultClient,
-		quit:   make(chan bool),
 	}, nil
 }
 
 func NewVaultIAMAuth(vaultAddress, vaultAuthMount, vaultAuthHeader, role string, vaultConfig *api.Config) (*VaultIAMAuth, error) {
-	vaultTokenAuth, err := NewVaultTokenAuth("", vaultConfig)
+	vaultClient, err := newVaultClient("", vaultConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -29,12 +34,12 @@ func NewVaultIAMAuth(vaultAddress, vaultAuthMount, vaultAuthHeader, role string,
 		vaultAuthMount:  vaultAuthMount,
 		vaultAuthRole:   role,
 		vaultAuthHeader: vaultAuthHeader,
-		VaultTokenAuth:  *vaultTokenAuth,
+		VaultTokenAuth:  VaultTokenAuth{Client: vaultClient},
 	}, nil
 }
 
 func NewVaultK8sAuth(vaultAddress, vaultAuthMount, tokenPath, role string, vaultConfig *api.Config) (*VaultK8sAuth, error) {
-	vaultTokenAuth, err := NewVaultTokenAuth("", vaultConfig)
+	vaultClient, err := newVaultClient("", vaultConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -46,10 +51,57 @@ func NewVaultK8sAuth(vaultAddress, vaultAuthMount, tokenPath, role string, vault
 		httpClient: &http.Client{
 			Timeout: time.Second * 10,
 		},
-		VaultTokenAuth: *vaultTokenAuth,
+		VaultTokenAuth: VaultTokenAuth{Client: vaultClient},
+	}, nil
+}
+
+func NewVaultAppRoleAuth(vaultAuthMount, roleID string, secretID VaultSecretIDSource, vaultConfig *api.Config) (*VaultAppRoleAuth, error) {
+	vaultClient, err := newVaultClient("", vaultConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &VaultAppRoleAuth{
+		vaultAuthMount: vaultAuthMount,
+		roleID:         roleID,
+		secretID:       secretID,
+		VaultTokenAuth: VaultTokenAuth{Client: vaultClient},
 	}, nil
 }
 
+func NewVaultCertAuth(vaultAuthMount, role string, vaultConfig *api.Config) (*VaultCertAuth, error) {
+	vaultClient, err := newVaultClient("", vaultConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &VaultCertAuth{
+		vaultAuthMount: vaultAuthMount,
+		role:           role,
+		VaultTokenAuth: VaultTokenAuth{Client: vaultClient},
+	}, nil
+}
+
+func NewVaultJWTAuth(vaultAuthMount, role string, jwt VaultJWTSource, vaultConfig *api.Config) (*VaultJWTAuth, error) {
+	vaultClient, err := newVaultClient("", vaultConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &VaultJWTAuth{
+		vaultAuthMount: vaultAuthMount,
+		role:           role,
+		jwt:            jwt,
+		VaultTokenAuth: VaultTokenAuth{Client: vaultClient},
+	}, nil
+}
+
+func newVaultClient(token string, vaultConfig *api.Config) (*api.Client, error) {
+	vaultClient, err := api.NewClient(vaultConfig)
+	if err != nil {
+		return nil, err
+	}
+	vaultClient.SetToken(token)
+	return vaultClient, nil
+}
+
 func NewVaultApiConfig(address string, agent bool) *api.Config {
 	config := &api.Config{
 		HttpClient: &http.Client{
@@ -65,10 +117,30 @@ func NewVaultApiConfig(address string, agent bool) *api.Config {
 	return config
 }
 
+// NewVaultApiConfigWithTLS creates config with TLS settings, e.g. client certificate for VaultCertAuth
+func NewVaultApiConfigWithTLS(address string, agent bool, tlsConfig *api.TLSConfig) (*api.Config, error) {
+	config := NewVaultApiConfig(address, agent)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	config.HttpClient.Transport = transport
+	if err := config.ConfigureTLS(tlsConfig); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// NewStorageVault creates vault storage, KV engine version is detected if vaultDataKey is empty or "data"
 func NewStorageVault(auth VaultAuthenticate, vaultDataKey string) (*StorageVault, error) {
 	return &StorageVault{
 		VaultAuthenticate: auth,
 		vaultDataKey:      vaultDataKey,
+		undetected:        make(map[string]bool),
+		metadata:          make(map[secretVersion]SecretMetadata),
+		leases:            make(map[string]*vaultLease),
+		leaseNotify:       make(chan struct{}, 1),
 	}, nil
 }
 
@@ -78,6 +150,122 @@ func NewEnvReader() EnvReader {
 	}
 }
 
+// NewEnvReaderWithPrefix creates env reader which adds prefix to the variable names
+func NewEnvReaderWithPrefix(prefix string) EnvReader {
+	reader := NewEnvReader()
+	reader.Prefix = prefix
+	return reader
+}
+
+func NewFileReader(path string) FileReader {
+	return NewFileReaderWithFormat(path, fileFormat(path))
+}
+
+func NewFileReaderWithFormat(path, format string) FileReader {
+	return FileReader{
+		path:     path,
+		format:   format,
+		tag:      "file",
+		watcher:  newFileWatcher(path),
+		snapshot: &sourceSnapshot{},
+	}
+}
+
+// NewDotenvReader creates reader of the .env files, the latter file overrides variables of the former one,
+// missing files are skipped, e.g. NewDotenvReader(".env", ".env.local", ".env."+os.Getenv("ENV"))
+func NewDotenvReader(files ...string) DotenvReader {
+	return DotenvReader{
+		files:    files,
+		tag:      "env",
+		watcher:  newFileWatcher(files...),
+		snapshot: &sourceSnapshot{},
+	}
+}
+
+// NewDirectoryReader creates reader of the directories with a file per key (e.g. kubernetes ConfigMap or Secret volumes),
+// the latter directory overrides files of the former one, missing directories are skipped
+func NewDirectoryReader(dirs ...string) DirectoryReader {
+	return DirectoryReader{
+		dirs:     dirs,
+		tag:      "dir",
+		watcher:  newDirWatcher(dirs...),
+		snapshot: &sourceSnapshot{},
+	}
+}
+
+// NewFlagReader creates reader of the flags from args, flags are registered in the provided flag set
+func NewFlagReader(flagSet *flag.FlagSet, args []string) FlagReader {
+	return FlagReader{
+		flagSet: flagSet,
+		args:    args,
+		tag:     "flag",
+		state: &flagState{
+			values: make(map[string]string),
+		},
+	}
+}
+
+// NewCommandLineFlagReader creates reader of the command-line flags
+func NewCommandLineFlagReader() FlagReader {
+	return NewFlagReader(flag.CommandLine, os.Args[1:])
+}
+
+// NewConsulReader creates reader of the Consul KV entries by the agent address (e.g. http://127.0.0.1:8500),
+// prefix is added to all the keys
+func NewConsulReader(address, prefix string) ConsulReader {
+	return ConsulReader{
+		address: address,
+		prefix:  prefix,
+		tag:     "consul",
+		state: &consulState{
+			indexes: make(map[string]uint64),
+			notify:  make(chan struct{}, 1),
+		},
+	}
+}
+
+// NewEtcdReader creates reader of the etcd v3 keys by the gateway endpoint (e.g. http://127.0.0.1:2379),
+// prefix is added to all the keys
+func NewEtcdReader(endpoint, prefix string) EtcdReader {
+	return EtcdReader{
+		endpoint: endpoint,
+		prefix:   prefix,
+		tag:      "etcd",
+		state: &etcdState{
+			notify: make(chan struct{}, 1),
+		},
+	}
+}
+
+// NewSSMReader creates reader of the SSM parameters under the path (e.g. /app/prod/), parameter names of the tags
+// are relative to the path. Parameters are read by names if the path is empty.
+// Configs could override the session settings, e.g. region or endpoint
+func NewSSMReader(sess client.ConfigProvider, path string, configs ...*aws.Config) SSMReader {
+	return SSMReader{
+		client: ssm.New(sess, configs...),
+		path:   path,
+		tag:    "ssm",
+	}
+}
+
+// NewSecretsManagerReader creates reader of the Secrets Manager secrets,
+// configs could override the session settings, e.g. region or endpoint
+func NewSecretsManagerReader(sess client.ConfigProvider, configs ...*aws.Config) SecretsManagerReader {
+	return SecretsManagerReader{
+		client: secretsmanager.New(sess, configs...),
+		tag:    "secretsmanager",
+	}
+}
+
+// NewHTTPReader creates reader of the JSON document by URL
+func NewHTTPReader(url string) HTTPReader {
+	return HTTPReader{
+		url:   url,
+		tag:   "http",
+		state: &httpState{},
+	}
+}
+
 func NewVaultReader(storage *StorageVault) VaultReader {
 	return VaultReader{
 		storage: storage,
@@ -92,9 +280,10 @@ func NewVaultReaderWithFormatter(storage *StorageVault, formatter SecretPathForm
 }
 
 func NewConfigService(interval time.Duration) *Service {
-	service := &Service{}
+	service := &Service{
+		Debounce: DefaultDebounce,
+	}
 	if interval > 0 {
-		service.quit = make(chan bool)
 		service.interval = interval
 	}
 	return service
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+type (
+	// Logger is a structured logger, keysAndValues are alternating keys and values, e.g. "field", "Port", "provider", "env"
+	Logger interface {
+		Debug(msg string, keysAndValues ...interface{})
+		Info(msg string, keysAndValues ...interface{})
+		Warn(msg string, keysAndValues ...interface{})
+		Error(msg string, keysAndValues ...interface{})
+	}
+
+	// LogLevel is a severity of the message
+	LogLevel int
+
+	// stdLogger writes messages of the level and above by the standard logger
+	stdLogger struct {
+		logger *log.Logger
+		level  LogLevel
+	}
+
+	// libLogger is a default logger, it writes messages by LibLogger, so Verbose and custom LibLogger keep working
+	libLogger struct{}
+
+	// levelLogger could be implemented by a logger which skips messages of some levels,
+	// so the values of the skipped messages are not built
+	levelLogger interface {
+		enabled(level LogLevel) bool
+	}
+)
+
+// NewStdLogger creates logger which writes messages of the level and above by the standard logger as
+// "LEVEL message key=value ...", nil logger writes to stderr
+func NewStdLogger(logger *log.Logger, level LogLevel) Logger {
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return stdLogger{logger: logger, level: level}
+}
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+func (l stdLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log(LevelDebug, msg, keysAndValues)
+}
+
+func (l stdLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.log(LevelInfo, msg, keysAndValues)
+}
+
+func (l stdLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log(LevelWarn, msg, keysAndValues)
+}
+
+func (l stdLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.log(LevelError, msg, keysAndValues)
+}
+
+func (l stdLogger) log(level LogLevel, msg string, keysAndValues []interface{}) {
+	if level >= l.level {
+		l.logger.Println(formatLog(level, msg, keysAndValues))
+	}
+}
+
+func (l stdLogger) enabled(level LogLevel) bool {
+	return level >= l.level
+}
+
+func (libLogger) Debug(msg string, keysAndValues ...interface{}) {
+	LibLogger(formatLog(LevelDebug, msg, keysAndValues))
+}
+
+func (libLogger) Info(msg string, keysAndValues ...interface{}) {
+	LibLogger(formatLog(LevelInfo, msg, keysAndValues))
+}
+
+func (libLogger) Warn(msg string, keysAndValues ...interface{}) {
+	LibLogger(formatLog(LevelWarn, msg, keysAndValues))
+}
+
+func (libLogger) Error(msg string, keysAndValues ...interface{}) {
+	LibLogger(formatLog(LevelError, msg, keysAndValues))
+}
+
+// messages of the default logger are skipped if Verbose is off and LibLogger is not replaced
+func (libLogger) enabled(LogLevel) bool {
+	return Verbose || reflect.ValueOf(LibLogger).Pointer() != reflect.ValueOf(defaultLogger).Pointer()
+}
+
+// logEnabled reports whether the logger writes messages of the level, unknown loggers write all the messages
+func logEnabled(logger Logger, level LogLevel) bool {
+	if l, ok := logger.(levelLogger); ok {
+		return l.enabled(level)
+	}
+	return true
+}
+
+// loggerOrDefault returns the logger or the default one if it is not set
+func loggerOrDefault(logger Logger) Logger {
+	if logger == nil {
+		return libLogger{}
+	}
+	return logger
+}
+
+// formatLog formats message as "LEVEL message key=value ...", values with spaces are quoted
+func formatLog(level LogLevel, msg string, keysAndValues []interface{}) string {
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var value interface{} = "!MISSING"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		s := fmt.Sprintf("%v", value)
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = fmt.Sprintf("%q", s)
+		}
+		fmt.Fprintf(&b, " %v=%s", keysAndValues[i], s)
+	}
+	return b.String()
+}
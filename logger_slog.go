@@ -0,0 +1,51 @@
+//go:build go1.21
+// +build go1.21
+
+package config
+
+import (
+	"context"
+	"log/slog"
+)
+
+// slogLogger writes messages by log/slog logger
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger creates logger which writes messages by log/slog logger, nil logger means slog.Default()
+func NewSlogLogger(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return slogLogger{logger: logger}
+}
+
+func (l slogLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.logger.Debug(msg, keysAndValues...)
+}
+
+func (l slogLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.logger.Info(msg, keysAndValues...)
+}
+
+func (l slogLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.logger.Warn(msg, keysAndValues...)
+}
+
+func (l slogLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.logger.Error(msg, keysAndValues...)
+}
+
+func (l slogLogger) enabled(level LogLevel) bool {
+	slogLevel := slog.LevelError
+	switch level {
+	case LevelDebug:
+		slogLevel = slog.LevelDebug
+	case LevelInfo:
+		slogLevel = slog.LevelInfo
+	case LevelWarn:
+		slogLevel = slog.LevelWarn
+	}
+	return l.logger.Enabled(context.Background(), slogLevel)
+}
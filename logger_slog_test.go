@@ -0,0 +1,58 @@
+//go:build go1.21
+// +build go1.21
+
+package config_test
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	libConfig "github.com/MiG-21/go-lib-config"
+)
+
+var _ = Describe("Config", func() {
+	Context("SlogLogger", func() {
+		It("Levels and fields test should be Ok", func() {
+			var buf bytes.Buffer
+			handler := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+				Level: slog.LevelInfo,
+				// time is dropped to keep the output stable
+				ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+					if attr.Key == slog.TimeKey && len(groups) == 0 {
+						return slog.Attr{}
+					}
+					return attr
+				},
+			})
+			logger := libConfig.NewSlogLogger(slog.New(handler))
+
+			logger.Debug("skipped", "key", "value")
+			logger.Info("reader started", "reader", "config.EnvReader")
+			logger.Warn("refresh failed", "valid", false, "attempt", 2)
+			logger.Error("failed to revoke lease", "lease", "app/1")
+			Expect(buf.String()).To(Equal("level=INFO msg=\"reader started\" reader=config.EnvReader\n" +
+				"level=WARN msg=\"refresh failed\" valid=false attempt=2\n" +
+				"level=ERROR msg=\"failed to revoke lease\" lease=app/1\n"))
+		})
+		It("Debug values of the disabled level should not be formatted", func() {
+			defer os.Clearenv()
+			setEnv(map[string]string{"TEST_HOST": "localhost"})
+
+			type TestSlogCfg struct {
+				Host formattedValue `env:"TEST_HOST"`
+			}
+			var cfg TestSlogCfg
+			service := libConfig.NewConfigService(0)
+			service.Logger = libConfig.NewSlogLogger(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)))
+			formattedBefore := formattedCount()
+			_, err := service.ReadAndValidate(&cfg, libConfig.NewEnvReader())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Host).To(Equal(formattedValue("localhost")))
+			Expect(formattedCount()).To(Equal(formattedBefore))
+		})
+	})
+})
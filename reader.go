@@ -1,13 +1,15 @@
 package config
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"reflect"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/pkg/errors"
+	"github.com/hashicorp/go-multierror"
 )
 
 const (
@@ -16,18 +18,65 @@ const (
 	TagDataDefault     = "data-default"
 	TagDataDescription = "data-description"
 	TagDataNotLogging  = "data-not-logging"
+	TagDataRequired    = "data-required"
+	// TagDataProviders restricts the field to the readers with the listed tags, e.g. data-providers:"vault,file"
+	TagDataProviders = "data-providers"
+	// TagDataMerge merges maps and appends slices provided by several readers instead of replacing them
+	TagDataMerge = "data-merge"
 
 	// DefaultSeparator is a default list and map Separator character
 	DefaultSeparator = ","
 )
 
+// readerTags are the tags of the library readers
+var readerTags = []string{"env", "file", "dir", "flag", "vault", "consul", "etcd", "ssm", "secretsmanager", "http"}
+
 type (
-	// Reader should be implemented by custom reader
+	// Reader should be implemented by custom reader. Missing values are not errors of the reader,
+	// required fields which are not set by any of the readers are reported by the service
 	Reader interface {
 		Read(metas []StructMeta) error
 		Stop()
 	}
 
+	// ContextReader could be implemented by a reader which supports cancellation and deadlines
+	ContextReader interface {
+		ReadContext(ctx context.Context, metas []StructMeta) error
+	}
+
+	// Preparer could be implemented by a reader which loads the whole source at once, Prepare is called
+	// with the refresh context before ListSize and Read, so both of them are served from the same snapshot.
+	// The reader is skipped by the refresh if Prepare is failed
+	Preparer interface {
+		Prepare(ctx context.Context) error
+	}
+
+	// errorProvider is implemented by the library readers, the provider is set to the reader errors
+	// which are not related to a field, e.g. the file path of the invalid document
+	errorProvider interface {
+		provider() string
+	}
+
+	// Watcher could be implemented by a reader which is able to notify about source changes,
+	// every notification triggers config refresh if Service.Watch is turned on,
+	// the reader could close the channel to stop watching
+	Watcher interface {
+		Watch() (<-chan struct{}, error)
+	}
+
+	// leaseWatcher is implemented by the readers of the expiring secrets (e.g. vault dynamic secrets),
+	// expired secrets should be read again, so the reader is watched even if Service.Watch is off
+	leaseWatcher interface {
+		Watcher
+		leased() bool
+	}
+
+	// publishListener is implemented by the readers which should know that the config read by them
+	// has been validated and published, e.g. to release the resources of the replaced values
+	publishListener interface {
+		published()
+	}
+
 	// Setter gives an ability to implement custom setter for a field or struct
 	Setter interface {
 		SetValue(string) error
@@ -38,9 +87,17 @@ type (
 		Update() error
 	}
 
+	// ListSizer could be implemented by a reader which supports lists of structures,
+	// it returns the number of the list items in the source or -1 if the source doesn't define the list
+	ListSizer interface {
+		ListSize(list StructMeta) int
+	}
+
 	// StructMeta is a structure metadata entity
 	StructMeta struct {
-		FieldName        string
+		FieldName string
+		// Path is a fully-qualified path of the field, e.g. Database.Port or Upstreams[0].Host
+		Path             string
 		FieldValue       reflect.Value
 		Tag              *reflect.StructTag
 		Layout           string
@@ -49,59 +106,164 @@ type (
 		DefValueProvided bool
 		Description      string
 		NotLogging       bool
-		Provider         string
+		Required         bool
+		// Providers are the reader tags the field is restricted to, any reader could set the field if it is empty
+		Providers []string
+		Merge     bool
+		Provider  string
+
+		// parents are the nested structure fields the field belongs to, from the root one
+		parents []structParent
+		// allocs are the nil structure pointers the field belongs to, they are allocated once the field is set
+		allocs []structAlloc
+		// firstWins keeps the value of the first reader which has set the field
+		firstWins bool
+	}
+
+	// structParent describes the nested structure field
+	structParent struct {
+		name      string
+		tag       reflect.StructTag
+		anonymous bool
+		// index of the list item, -1 for the structure field
+		index int
+	}
+
+	// structAlloc keeps the nil pointer field and the structure allocated for it
+	structAlloc struct {
+		field reflect.Value
+		value reflect.Value
+	}
+
+	// structNode is a structure in the parsing stack
+	structNode struct {
+		value   reflect.Value
+		parents []structParent
+		allocs  []structAlloc
 	}
 )
 
-// ReadStructMetadata reads structure metadata (types, tags, etc.)
+var (
+	timeType   = reflect.TypeOf(time.Time{})
+	setterType = reflect.TypeOf((*Setter)(nil)).Elem()
+)
+
+// ReadStructMetadata reads structure metadata (types, tags, etc.).
+// The structure is not modified, fields of the nil structure pointers refer to the temporary allocated structures
 func ReadStructMetadata(cfgRoot interface{}) ([]StructMeta, error) {
-	cfgStack := []interface{}{cfgRoot}
-	metas := make([]StructMeta, 0)
+	metas, _, err := readStructMetadata(cfgRoot)
+	return metas, err
+}
 
-	for i := 0; i < len(cfgStack); i++ {
-		s := reflect.ValueOf(cfgStack[i])
+// readStructMetadata reads metadata of the fields and of the lists of structures
+func readStructMetadata(cfgRoot interface{}) ([]StructMeta, []StructMeta, error) {
+	root := reflect.ValueOf(cfgRoot)
 
-		// unwrap pointer
-		if s.Kind() == reflect.Ptr {
-			s = s.Elem()
-		}
+	// unwrap pointer
+	if root.Kind() == reflect.Ptr {
+		root = root.Elem()
+	}
 
-		// process only structures
-		if s.Kind() != reflect.Struct {
-			return nil, fmt.Errorf("wrong type %v", s.Kind())
-		}
+	// process only structures
+	if root.Kind() != reflect.Struct {
+		return nil, nil, fmt.Errorf("wrong type %v", root.Kind())
+	}
+
+	cfgStack := []structNode{{value: root}}
+	metas := make([]StructMeta, 0)
+	lists := make([]StructMeta, 0)
+	// structures referenced by pointers are parsed once, so cyclic configs don't hang the parsing
+	visited := make(map[cloneKey]bool)
+	if root.CanAddr() {
+		visited[cloneKey{typ: root.Addr().Type(), ptr: root.Addr().Pointer()}] = true
+	}
+
+	for i := 0; i < len(cfgStack); i++ {
+		node := cfgStack[i]
+		s := node.value
 		typeInfo := s.Type()
 
 		// read tags
 		for idx := 0; idx < s.NumField(); idx++ {
 			fType := typeInfo.Field(idx)
+			fld := s.Field(idx)
+
+			// unexported fields are skipped, embedded structures could have exported fields
+			if !fld.CanSet() && !fType.Anonymous {
+				continue
+			}
 
 			var (
 				layout    string
 				separator string
 			)
 
-			// process nested structure (except of time.Time)
-			if fld := s.Field(idx); fld.Kind() == reflect.Struct {
-				// add structure to parsing stack
-				if fld.Type() != reflect.TypeOf(time.Time{}) {
-					cfgStack = append(cfgStack, fld.Addr().Interface())
-					continue
+			parent := structParent{
+				name:      fType.Name,
+				tag:       fType.Tag,
+				anonymous: fType.Anonymous,
+				index:     -1,
+			}
+
+			// process nested structure or structure pointer (except of time.Time and setters)
+			if isNestedStruct(fld.Type()) || (fld.Kind() == reflect.Ptr && isNestedStruct(fld.Type().Elem())) {
+				if fld.Kind() == reflect.Ptr && !fld.IsNil() {
+					key := cloneKey{typ: fld.Type(), ptr: fld.Pointer()}
+					if visited[key] {
+						continue
+					}
+					visited[key] = true
 				}
-				// process time.Time
-				if l, ok := fType.Tag.Lookup(TagDataLayout); ok {
-					layout = l
+				if n, ok := nestedNode(fld, appendParent(node.parents, parent), node.allocs); ok {
+					cfgStack = append(cfgStack, n)
 				}
+				continue
 			}
 
 			// check is the field value can be changed
-			if !s.Field(idx).CanSet() {
+			if !fld.CanSet() {
+				continue
+			}
+
+			// process list of structures, every item is parsed as a nested structure
+			if fld.Kind() == reflect.Slice && (isNestedStruct(fld.Type().Elem()) ||
+				(fld.Type().Elem().Kind() == reflect.Ptr && isNestedStruct(fld.Type().Elem().Elem()))) {
+				lists = append(lists, StructMeta{
+					FieldName:  fType.Name,
+					Path:       fieldPath(node.parents, fType.Name),
+					FieldValue: fld,
+					Tag:        &fType.Tag,
+					Provider:   "-",
+					parents:    node.parents,
+					allocs:     node.allocs,
+				})
+				for j := 0; j < fld.Len(); j++ {
+					item := parent
+					item.index = j
+					if n, ok := nestedNode(fld.Index(j), appendParent(node.parents, item), node.allocs); ok {
+						cfgStack = append(cfgStack, n)
+					}
+				}
 				continue
 			}
 
+			// process time.Time
+			if fld.Type() == timeType {
+				if l, ok := fType.Tag.Lookup(TagDataLayout); ok {
+					layout = l
+				}
+			}
+
 			defValue, defValueProvided := fType.Tag.Lookup(TagDataDefault)
 			dataDescription, _ := fType.Tag.Lookup(TagDataDescription)
 			_, dataNotLogging := fType.Tag.Lookup(TagDataNotLogging)
+			_, dataRequired := fType.Tag.Lookup(TagDataRequired)
+			_, dataMerge := fType.Tag.Lookup(TagDataMerge)
+
+			var providers []string
+			if p, ok := fType.Tag.Lookup(TagDataProviders); ok && p != "" {
+				providers = strings.Split(p, ",")
+			}
 
 			if sep, ok := fType.Tag.Lookup(TagDataSeparator); ok {
 				separator = sep
@@ -110,8 +272,9 @@ func ReadStructMetadata(cfgRoot interface{}) ([]StructMeta, error) {
 			}
 
 			metas = append(metas, StructMeta{
-				FieldName:        s.Type().Field(idx).Name,
-				FieldValue:       s.Field(idx),
+				FieldName:        fType.Name,
+				Path:             fieldPath(node.parents, fType.Name),
+				FieldValue:       fld,
 				Tag:              &fType.Tag,
 				Layout:           layout,
 				Separator:        separator,
@@ -119,12 +282,197 @@ func ReadStructMetadata(cfgRoot interface{}) ([]StructMeta, error) {
 				DefValueProvided: defValueProvided,
 				Description:      dataDescription,
 				NotLogging:       dataNotLogging,
+				Required:         dataRequired,
+				Providers:        providers,
+				Merge:            dataMerge,
 				Provider:         "-",
+				parents:          node.parents,
+				allocs:           node.allocs,
 			})
 		}
 	}
 
-	return metas, nil
+	return metas, lists, nil
+}
+
+// isNestedStruct checks is the type a structure which fields should be parsed
+func isNestedStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != timeType &&
+		!t.Implements(setterType) && !reflect.PtrTo(t).Implements(setterType)
+}
+
+// nestedNode makes parsing stack node of the structure or structure pointer value.
+// Nil pointer is replaced by the temporary structure which is allocated once the field is set
+func nestedNode(v reflect.Value, parents []structParent, allocs []structAlloc) (structNode, bool) {
+	if v.Kind() == reflect.Ptr {
+		if !v.CanSet() {
+			return structNode{}, false
+		}
+		if v.IsNil() {
+			// temporary structure of the recursive type is allocated once, so it is not nested infinitely
+			for _, alloc := range allocs {
+				if alloc.value.Type() == v.Type() {
+					return structNode{}, false
+				}
+			}
+			value := reflect.New(v.Type().Elem())
+			allocs = append(allocs[:len(allocs):len(allocs)], structAlloc{field: v, value: value})
+			v = value
+		}
+		v = v.Elem()
+	}
+	return structNode{value: v, parents: parents, allocs: allocs}, true
+}
+
+// appendParent makes a copy of parents with the new one, so the parents of the sibling structures are not shared
+func appendParent(parents []structParent, parent structParent) []structParent {
+	return append(parents[:len(parents):len(parents)], parent)
+}
+
+// fieldPath builds dotted path of the field, embedded structures are skipped as their fields are promoted
+func fieldPath(parents []structParent, name string) string {
+	var b strings.Builder
+	for _, parent := range parents {
+		if parent.anonymous && parent.index < 0 {
+			continue
+		}
+		b.WriteString(parent.name)
+		if parent.index >= 0 {
+			b.WriteString("[" + strconv.Itoa(parent.index) + "]")
+		}
+		b.WriteString(".")
+	}
+	b.WriteString(name)
+	return b.String()
+}
+
+// inList checks is the field a part of the list item
+func (m StructMeta) inList() bool {
+	for _, parent := range m.parents {
+		if parent.index >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Accepts checks can the reader with the tag set the field. The field could be restricted to some readers
+// by data-providers tag, and in the first-wins mode the field which has been set by a former reader is skipped
+func (m StructMeta) Accepts(readerTag string) bool {
+	return m.allows(readerTag) && !(m.firstWins && !m.Merge && m.assigned())
+}
+
+// Assign parses raw value into the field and records the provider.
+// Maps and slices of the data-merge fields are merged with the values of the former readers instead of replacing
+func (m *StructMeta) Assign(provider, value string) error {
+	if m.Merge && m.assigned() && isMergeable(m.FieldValue.Type()) {
+		merged := reflect.New(m.FieldValue.Type()).Elem()
+		if err := parseValue(merged, value, m.Separator, m.Layout); err != nil {
+			return err
+		}
+		mergeValue(m.FieldValue, merged, !m.firstWins)
+	} else if err := parseValue(m.FieldValue, value, m.Separator, m.Layout); err != nil {
+		return err
+	}
+	m.Provider = provider
+	// nil structure pointers the field belongs to are allocated once any value is set, including the zero one
+	allocate(m.allocs)
+	return nil
+}
+
+// allows checks is the field restricted to the reader tag by data-providers tag
+func (m StructMeta) allows(readerTag string) bool {
+	if len(m.Providers) == 0 {
+		return true
+	}
+	for _, provider := range m.Providers {
+		if strings.TrimSpace(provider) == readerTag {
+			return true
+		}
+	}
+	return false
+}
+
+// assigned checks has the field been set by a reader, default values are not taken into account
+func (m StructMeta) assigned() bool {
+	return m.Provider != "-" && m.Provider != "default"
+}
+
+// isMergeable checks is the type a map or a slice or a pointer to them
+func isMergeable(t reflect.Type) bool {
+	kind := indirectType(t).Kind()
+	return kind == reflect.Map || kind == reflect.Slice
+}
+
+// mergeValue appends src slice items to dst or puts src map entries into dst,
+// existing map entries are kept unless overwrite is set
+func mergeValue(dst, src reflect.Value, overwrite bool) {
+	for dst.Kind() == reflect.Ptr {
+		if dst.IsNil() || src.IsNil() {
+			if !src.IsNil() {
+				dst.Set(src)
+			}
+			return
+		}
+		dst, src = dst.Elem(), src.Elem()
+	}
+
+	switch dst.Kind() {
+	case reflect.Slice:
+		dst.Set(reflect.AppendSlice(dst, src))
+	case reflect.Map:
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMapWithSize(dst.Type(), src.Len()))
+		}
+		iter := src.MapRange()
+		for iter.Next() {
+			if overwrite || !dst.MapIndex(iter.Key()).IsValid() {
+				dst.SetMapIndex(iter.Key(), iter.Value())
+			}
+		}
+	}
+}
+
+func allocate(allocs []structAlloc) {
+	for _, alloc := range allocs {
+		if alloc.field.IsNil() {
+			alloc.field.Set(alloc.value)
+		}
+	}
+}
+
+// resizeList changes length of the list keeping the existing items
+func resizeList(list reflect.Value, size int) {
+	resized := reflect.MakeSlice(list.Type(), size, size)
+	reflect.Copy(resized, list)
+	list.Set(resized)
+}
+
+// readContext reads by context aware reader if it is supported
+func readContext(ctx context.Context, reader Reader, metas []StructMeta) error {
+	if r, ok := reader.(ContextReader); ok {
+		return r.ReadContext(ctx, metas)
+	}
+	return reader.Read(metas)
+}
+
+// readerProvider returns the provider of the reader errors, type name is used for the custom readers
+func readerProvider(reader Reader) string {
+	if r, ok := reader.(errorProvider); ok {
+		return r.provider()
+	}
+	return fmt.Sprintf("%T", reader)
+}
+
+// longPollClient returns the client of the long-lived requests (watch streams and blocking queries),
+// they are limited by the request context, so the client Timeout is dropped. Transport of the client is shared
+func longPollClient(client *http.Client) *http.Client {
+	if client.Timeout == 0 {
+		return client
+	}
+	c := *client
+	c.Timeout = 0
+	return &c
 }
 
 // parseValue parses value into the corresponding field.
@@ -286,41 +634,39 @@ func parseMap(valueType reflect.Type, value, sep, layout string) (*reflect.Value
 
 // setDefaults data after populating
 func setDefaults(metas []StructMeta) error {
-	errCollector := errorCollector()
-	var cErr, err error
+	var result *multierror.Error
 	for k, meta := range metas {
 		if meta.DefValueProvided {
-			if err = parseValue(meta.FieldValue, meta.DefValue, meta.Separator, meta.Layout); err != nil {
-				cErr = errCollector(err)
+			if err := parseValue(meta.FieldValue, meta.DefValue, meta.Separator, meta.Layout); err != nil {
+				result = multierror.Append(result, newFieldError(meta, "default", TagDataDefault, meta.DefValue, ErrorParse, err))
 			} else {
 				metas[k].Provider = "default"
+				allocate(meta.allocs)
 			}
 		}
 	}
-	return cErr
+	return result.ErrorOrNil()
 }
 
-// dumpMetas by logger
-func dumpMetas(metas []StructMeta) {
-	for _, meta := range metas {
-		if meta.NotLogging {
-			LibLogger(fmt.Sprintf("%s = ********** [%s]", meta.FieldName, meta.Provider))
-		} else {
-			LibLogger(fmt.Sprintf("%s = %v [%s]", meta.FieldName, meta.FieldValue, meta.Provider))
+// hasReaderTag reports whether the field has a tag of the library readers
+func hasReaderTag(meta StructMeta) bool {
+	for _, tag := range readerTags {
+		if name, _ := meta.Tag.Lookup(tag); name != "" && name != "-" {
+			return true
 		}
 	}
+	return false
 }
 
-// errorCollector for populate errors without break read loop
-func errorCollector() func(err error) error {
-	var collectedErr error
-	return func(err error) error {
-		if collectedErr == nil {
-			collectedErr = err
-		} else {
-			collectedErr = errors.Wrap(collectedErr, err.Error())
-		}
-		return collectedErr
+// dumpMetas by logger, values of the data-not-logging fields are masked.
+// Values are not formatted if the logger skips debug messages
+func dumpMetas(logger Logger, metas []StructMeta) {
+	if !logEnabled(logger, LevelDebug) {
+		return
+	}
+	for _, meta := range metas {
+		value := metaValue(meta, fmt.Sprintf("%v", meta.FieldValue))
+		logger.Debug("field resolved", "field", meta.Path, "value", value, "provider", meta.Provider)
 	}
 }
 
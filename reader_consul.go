@@ -0,0 +1,309 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	// DefaultConsulWaitTime is a default max duration of the blocking query
+	DefaultConsulWaitTime = 5 * time.Minute
+	// consulRetryDelay is a delay between failed blocking queries
+	consulRetryDelay = 5 * time.Second
+	// consulMinQueryInterval is a minimum delay between the starts of the blocking queries,
+	// so the queries which return immediately (e.g. the index is missing or not advanced) don't spin
+	consulMinQueryInterval = time.Second
+)
+
+type (
+	// ConsulReader reads Consul KV entries, keys are batched by the reader prefix if it is set,
+	// otherwise by the parent path of the key, so a single recursive request is made per batch
+	ConsulReader struct {
+		address string
+		prefix  string
+		tag     string
+		state   *consulState
+		// Client is a HTTP client of the requests, e.g. with TLS settings.
+		// Its Timeout is not applied to the blocking queries, they are limited by WaitTime and the reader context
+		Client *http.Client
+		// Token is sent by X-Consul-Token header
+		Token string
+		// Datacenter of the KV store, the agent's one is used if it is not set
+		Datacenter string
+		// WaitTime limits blocking queries, DefaultConsulWaitTime is used if it is not set
+		WaitTime time.Duration
+		// Logger of the reader, LibLogger is used if it is not set
+		Logger Logger
+	}
+
+	// consulState keeps the batches and blocking queries of the reader
+	consulState struct {
+		mu sync.Mutex
+		// indexes are the last known modify indexes of the batches
+		indexes  map[string]uint64
+		watching bool
+		cancel   context.CancelFunc
+		ctx      context.Context
+		wg       sync.WaitGroup
+		notify   chan struct{}
+	}
+
+	// consulEntry is an entry of the KV API response
+	consulEntry struct {
+		Key   string
+		Value *string
+	}
+)
+
+// reads Consul KV entries to the provided configuration structure
+func (r ConsulReader) Read(metas []StructMeta) error {
+	return r.ReadContext(context.Background(), metas)
+}
+
+// ReadContext reads Consul KV entries, cancellation of the context interrupts requests
+func (r ConsulReader) ReadContext(ctx context.Context, metas []StructMeta) error {
+	logger := loggerOrDefault(r.Logger)
+	keys := make(map[int]string)
+	batches := make(map[string]map[string]string)
+	for k, meta := range metas {
+		tag, _ := meta.Tag.Lookup(r.tag)
+		// keys of the list items are not supported
+		if tag == "" || meta.inList() || !meta.Accepts(r.tag) {
+			continue
+		}
+		key := r.key(tag)
+		keys[k] = key
+		batches[r.batch(key)] = nil
+	}
+
+	var result *multierror.Error
+	for batch := range batches {
+		logger.Debug("reading batch", "prefix", batch)
+		entries, index, err := r.list(ctx, batch, 0)
+		if err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		batches[batch] = entries
+		r.state.track(r, batch, index)
+	}
+
+	for k, key := range keys {
+		meta := metas[k]
+		value, ok := batches[r.batch(key)][key]
+		if !ok {
+			logger.Debug("key is not set", "key", key)
+			continue
+		}
+		if err := metas[k].Assign(r.tag, value); err != nil {
+			result = multierror.Append(result, newFieldError(meta, r.tag, key, value, ErrorParse, err))
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+// Watch runs blocking queries of the batches, every forward move of the batch index is notified
+func (r ConsulReader) Watch() (<-chan struct{}, error) {
+	return r.state.watch(r), nil
+}
+
+// Stop blocking queries, it waits until they are finished
+func (r ConsulReader) Stop() {
+	r.state.stop()
+}
+
+func (r ConsulReader) provider() string {
+	return r.tag
+}
+
+// key returns the full key of the tag
+func (r ConsulReader) key(tag string) string {
+	if r.prefix == "" {
+		return strings.TrimPrefix(tag, "/")
+	}
+	return strings.TrimSuffix(r.prefix, "/") + "/" + strings.TrimPrefix(tag, "/")
+}
+
+// batch returns the batch prefix of the key, it is the reader prefix or the parent path of the key,
+// so the requests and blocking queries don't cover keys of other applications
+func (r ConsulReader) batch(key string) string {
+	if r.prefix != "" {
+		return strings.TrimSuffix(r.prefix, "/") + "/"
+	}
+	if idx := strings.LastIndex(key, "/"); idx >= 0 {
+		return key[:idx+1]
+	}
+	return key
+}
+
+// list reads entries of the batch recursively, it blocks until the batch index differs from index
+// or wait time is over if index is not 0. It returns values by the keys and the batch index
+func (r ConsulReader) list(ctx context.Context, batch string, index uint64) (map[string]string, uint64, error) {
+	u, err := url.Parse(strings.TrimSuffix(r.address, "/") + "/v1/kv/" + batch)
+	if err != nil {
+		return nil, 0, err
+	}
+	query := url.Values{"recurse": []string{"true"}}
+	if r.Datacenter != "" {
+		query.Set("dc", r.Datacenter)
+	}
+	if index > 0 {
+		wait := r.WaitTime
+		if wait <= 0 {
+			wait = DefaultConsulWaitTime
+		}
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(wait.Seconds())))
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.Token != "" {
+		req.Header.Set("X-Consul-Token", r.Token)
+	}
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if index > 0 {
+		client = longPollClient(client)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("consul %s: %w", batch, err)
+	}
+	defer resp.Body.Close()
+
+	index, _ = strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	values := make(map[string]string)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		// there are no keys in the batch
+		return values, index, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, 0, withCategory(ErrorAuth, fmt.Errorf("consul %s: %s", batch, resp.Status))
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return nil, 0, withCategory(ErrorTransport, fmt.Errorf("consul %s: %s", batch, resp.Status))
+	case resp.StatusCode != http.StatusOK:
+		return nil, 0, fmt.Errorf("consul %s: %s", batch, resp.Status)
+	}
+
+	var entries []consulEntry
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("consul %s: %w", batch, err)
+	}
+	for _, entry := range entries {
+		var value []byte
+		if entry.Value != nil {
+			if value, err = base64.StdEncoding.DecodeString(*entry.Value); err != nil {
+				return nil, 0, withCategory(ErrorParse, fmt.Errorf("consul %s: %w", entry.Key, err))
+			}
+		}
+		values[entry.Key] = string(value)
+	}
+
+	return values, index, nil
+}
+
+// track keeps the batch index, blocking query of the new batch is started if the reader is watching
+func (st *consulState) track(r ConsulReader, batch string, index uint64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.indexes[batch]; !ok && st.watching {
+		st.wg.Add(1)
+		go st.block(st.ctx, r, batch, index)
+	}
+	st.indexes[batch] = index
+}
+
+// watch starts blocking queries of the known batches once
+func (st *consulState) watch(r ConsulReader) <-chan struct{} {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.watching {
+		return st.notify
+	}
+	st.ctx, st.cancel = context.WithCancel(context.Background())
+	st.watching = true
+
+	for batch, index := range st.indexes {
+		st.wg.Add(1)
+		go st.block(st.ctx, r, batch, index)
+	}
+
+	return st.notify
+}
+
+// block runs blocking queries of the batch until the context is cancelled
+func (st *consulState) block(ctx context.Context, r ConsulReader, batch string, index uint64) {
+	defer st.wg.Done()
+
+	logger := loggerOrDefault(r.Logger)
+	for {
+		started := time.Now()
+		_, next, err := r.list(ctx, batch, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Warn("consul blocking query failed", "prefix", batch, "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(consulRetryDelay):
+			}
+			continue
+		}
+
+		switch {
+		case next > index:
+			if index > 0 {
+				logger.Debug("consul batch changed", "prefix", batch, "index", next)
+				select {
+				case st.notify <- struct{}{}:
+				default:
+				}
+			}
+			index = next
+		case next > 0 && next < index:
+			// index went backwards (e.g. after snapshot restore), so it is reset
+			index = 0
+		}
+		// the missing or not advanced index is kept, queries are rate limited, so they don't spin
+		// if the index doesn't block them
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(consulMinQueryInterval - time.Since(started)):
+		}
+	}
+}
+
+// stop blocking queries
+func (st *consulState) stop() {
+	st.mu.Lock()
+	if st.cancel != nil {
+		st.cancel()
+		st.cancel = nil
+	}
+	st.watching = false
+	st.mu.Unlock()
+	st.wg.Wait()
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// DirectoryReader reads mounted directories with a file per key, e.g. kubernetes ConfigMap or Secret volumes.
+// Directories are layered, so the file of the latter directory overrides the file of the former one
+type DirectoryReader struct {
+	dirs     []string
+	tag      string
+	watcher  *fileWatcher
+	snapshot *sourceSnapshot
+	// DeriveNames turns on derivation of the file names from the field path for the fields without tag,
+	// names are derived the same way as EnvReader does, e.g. Database.MaxConns is read from DATABASE_MAX_CONNS
+	DeriveNames bool
+	// TrimNewline removes trailing newlines of the file content
+	TrimNewline bool
+	// Logger of the reader, LibLogger is used if it is not set
+	Logger Logger
+}
+
+// dirFile is a file of the key, path is the file in the mount directory and source is the file to read,
+// they differ for kubernetes volumes where source is the file of the timestamped directory
+type dirFile struct {
+	path   string
+	source string
+}
+
+// reads files of the directories to the provided configuration structure
+func (r DirectoryReader) Read(metas []StructMeta) error {
+	files, ok := r.snapshot.take().(map[string]dirFile)
+	if !ok {
+		var err error
+		if files, err = r.load(); err != nil {
+			return err
+		}
+	}
+
+	logger := loggerOrDefault(r.Logger)
+	var result *multierror.Error
+	for k, meta := range metas {
+		tag := envName(meta, r.tag, "", r.DeriveNames)
+		if tag == "" || !meta.Accepts(r.tag) {
+			continue
+		}
+
+		logger.Debug("reading file", "key", tag)
+
+		file, ok := files[tag]
+		if !ok {
+			logger.Debug("file is not found", "key", tag, "dirs", strings.Join(r.dirs, ","))
+			continue
+		}
+
+		data, err := ioutil.ReadFile(file.source)
+		if err != nil {
+			result = multierror.Append(result, newFieldError(meta, file.path, tag, "", errorCategory(err, ErrorParse), err))
+			continue
+		}
+		value := string(data)
+		if r.TrimNewline {
+			value = strings.TrimRight(value, "\r\n")
+		}
+
+		if err = metas[k].Assign(file.path, value); err != nil {
+			result = multierror.Append(result, newFieldError(meta, file.path, tag, value, ErrorParse, err))
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+// Prepare lists files of the refresh, ListSize and the following Read use them,
+// so the files of the kubernetes volume belong to the same update
+func (r DirectoryReader) Prepare(context.Context) error {
+	files, err := r.load()
+	if err != nil {
+		return err
+	}
+	r.snapshot.set(files)
+	return nil
+}
+
+// ListSize returns the number of the list items defined by the files, e.g. UPSTREAMS_0_HOST and UPSTREAMS_1_HOST
+func (r DirectoryReader) ListSize(list StructMeta) int {
+	files, ok := r.snapshot.current().(map[string]dirFile)
+	if !ok {
+		var err error
+		if files, err = r.load(); err != nil {
+			return -1
+		}
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	return envListSize(list, "", r.DeriveNames, names)
+}
+
+// Watch notifies about changes of the directories files
+func (r DirectoryReader) Watch() (<-chan struct{}, error) {
+	return r.watcher.Watch(loggerOrDefault(r.Logger))
+}
+
+func (r DirectoryReader) Stop() {
+	r.watcher.Stop()
+}
+
+func (r DirectoryReader) provider() string {
+	return r.tag
+}
+
+// load lists files of the directories, missing directories are skipped.
+// Files of the kubernetes volume are listed in the directory "..data" symlink points to,
+// so all the files of the refresh belong to the same volume update
+func (r DirectoryReader) load() (map[string]dirFile, error) {
+	files := make(map[string]dirFile)
+	for _, dir := range r.dirs {
+		root := dir
+		if resolved, err := filepath.EvalSymlinks(filepath.Join(dir, k8sDataDir)); err == nil {
+			root = resolved
+		}
+
+		entries, err := ioutil.ReadDir(root)
+		if os.IsNotExist(err) {
+			loggerOrDefault(r.Logger).Debug("directory is not found, skipped", "path", dir)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			// hidden files and kubernetes service entries are skipped
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			source := filepath.Join(root, entry.Name())
+			// entry could be a symlink, so the target is checked
+			if info, err := os.Stat(source); err != nil || info.IsDir() {
+				continue
+			}
+			files[entry.Name()] = dirFile{path: filepath.Join(dir, entry.Name()), source: source}
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,328 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// DotenvReader reads variables of the .env files, files are layered, so the latter file overrides the former one.
+// Process environment is used for interpolation only and is never modified
+type DotenvReader struct {
+	files    []string
+	tag      string
+	watcher  *fileWatcher
+	snapshot *sourceSnapshot
+	// Logger of the reader, LibLogger is used if it is not set
+	Logger Logger
+}
+
+// dotenvSnapshot is the variables of the .env files and the files they are defined in
+type dotenvSnapshot struct {
+	values  map[string]string
+	sources map[string]string
+}
+
+// reads .env files variables to the provided configuration structure
+func (r DotenvReader) Read(metas []StructMeta) error {
+	snapshot, ok := r.snapshot.take().(dotenvSnapshot)
+	if !ok {
+		var err error
+		if snapshot.values, snapshot.sources, err = r.load(); err != nil {
+			return err
+		}
+	}
+	values, sources := snapshot.values, snapshot.sources
+
+	logger := loggerOrDefault(r.Logger)
+	var result *multierror.Error
+	for k, meta := range metas {
+		tag := envName(meta, r.tag, "", false)
+		if tag == "" || !meta.Accepts(r.tag) {
+			continue
+		}
+
+		logger.Debug("reading variable", "key", tag)
+
+		value, ok := values[tag]
+		if !ok {
+			logger.Debug("variable is not set", "key", tag, "files", strings.Join(r.files, ","))
+			continue
+		}
+
+		if err := metas[k].Assign(sources[tag], value); err != nil {
+			result = multierror.Append(result, newFieldError(meta, sources[tag], tag, value, ErrorParse, err))
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+// Prepare parses the files of the refresh, ListSize and the following Read use them
+func (r DotenvReader) Prepare(context.Context) error {
+	values, sources, err := r.load()
+	if err != nil {
+		return err
+	}
+	r.snapshot.set(dotenvSnapshot{values: values, sources: sources})
+	return nil
+}
+
+// ListSize returns the number of the list items defined by the .env files variables
+func (r DotenvReader) ListSize(list StructMeta) int {
+	snapshot, ok := r.snapshot.current().(dotenvSnapshot)
+	if !ok {
+		var err error
+		if snapshot.values, _, err = r.load(); err != nil {
+			return -1
+		}
+	}
+	values := snapshot.values
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	return envListSize(list, "", false, names)
+}
+
+// Watch notifies about .env files changes
+func (r DotenvReader) Watch() (<-chan struct{}, error) {
+	return r.watcher.Watch(loggerOrDefault(r.Logger))
+}
+
+func (r DotenvReader) Stop() {
+	r.watcher.Stop()
+}
+
+func (r DotenvReader) provider() string {
+	return r.tag
+}
+
+// load parses all the files, missing files are skipped. It returns variables and files they are defined in
+func (r DotenvReader) load() (map[string]string, map[string]string, error) {
+	values := make(map[string]string)
+	sources := make(map[string]string)
+	for _, path := range r.files {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			loggerOrDefault(r.Logger).Debug("file is not found, skipped", "path", path)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		keys, err := parseDotenv(string(data), values)
+		if err != nil {
+			return nil, nil, withCategory(ErrorParse, fmt.Errorf("%s: %w", path, err))
+		}
+		for _, key := range keys {
+			sources[key] = path
+		}
+	}
+	return values, sources, nil
+}
+
+// parseDotenv parses .env document into values, values which are already there could be interpolated.
+// It returns the keys defined by the document
+func parseDotenv(data string, values map[string]string) ([]string, error) {
+	lookup := func(name string) (string, bool) {
+		if value, ok := values[name]; ok {
+			return value, true
+		}
+		return os.LookupEnv(name)
+	}
+
+	keys := make([]string, 0)
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimLeft(lines[i], " \t")
+		if strings.TrimSpace(line) == "" || line[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(line, "export ") {
+			line = strings.TrimLeft(line[len("export "):], " \t")
+		}
+
+		idx := strings.Index(line, "=")
+		if idx < 0 {
+			return nil, fmt.Errorf("line %d: missing '='", lineNo)
+		}
+		key := strings.TrimSpace(line[:idx])
+		if !isEnvName(key) {
+			return nil, fmt.Errorf("line %d: invalid variable name %q", lineNo, key)
+		}
+
+		var (
+			value string
+			err   error
+		)
+		raw := strings.TrimLeft(line[idx+1:], " \t")
+		if raw != "" && (raw[0] == '"' || raw[0] == '\'') {
+			// quoted value could span several lines
+			quote, body := raw[0], raw[1:]
+			for {
+				if end := closingQuote(body, quote); end >= 0 {
+					if rest := strings.TrimSpace(body[end+1:]); rest != "" && rest[0] != '#' {
+						return nil, fmt.Errorf("line %d: unexpected %q after quoted value", lineNo, rest)
+					}
+					body = body[:end]
+					break
+				}
+				if i++; i >= len(lines) {
+					return nil, fmt.Errorf("line %d: unterminated quoted value", lineNo)
+				}
+				body += "\n" + lines[i]
+			}
+			// single quoted values are literal
+			if quote == '\'' {
+				value = body
+			} else {
+				value, err = expandDotenv(body, lookup, true)
+			}
+		} else {
+			// inline comment should be separated by a whitespace, e.g. COLOR=#fff is a value,
+			// raw differs from the line rest if the leading whitespaces have been trimmed
+			if strings.HasPrefix(raw, "#") && raw != line[idx+1:] {
+				raw = ""
+			} else if idx := strings.Index(raw, " #"); idx >= 0 {
+				raw = raw[:idx]
+			} else if idx := strings.Index(raw, "\t#"); idx >= 0 {
+				raw = raw[:idx]
+			}
+			value, err = expandDotenv(strings.TrimSpace(raw), lookup, false)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+
+		values[key] = value
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// closingQuote finds the closing quote, double quoted value could contain escaped quotes
+func closingQuote(s string, quote byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quote == '"' {
+				i++
+			}
+		case quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// expandDotenv interpolates $VAR, ${VAR}, ${VAR:-default} and ${VAR-default} references,
+// escape sequences are processed for double quoted values only
+func expandDotenv(s string, lookup func(string) (string, bool), escapes bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && escapes && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(s[i])
+			}
+
+		case c == '$' && i+1 < len(s) && s[i+1] == '{':
+			end := closingBrace(s, i+2)
+			if end < 0 {
+				return "", fmt.Errorf("unterminated reference %q", s[i:])
+			}
+			value, err := expandDotenvReference(s[i+2:end], lookup)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i = end
+
+		case c == '$' && i+1 < len(s) && isEnvNameStart(s[i+1]):
+			j := i + 1
+			for j < len(s) && isEnvNameChar(s[j]) {
+				j++
+			}
+			value, _ := lookup(s[i+1 : j])
+			b.WriteString(value)
+			i = j - 1
+
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// expandDotenvReference resolves the content of ${...} reference
+func expandDotenvReference(ref string, lookup func(string) (string, bool)) (string, error) {
+	name, defValue, unsetOnly, hasDefault := ref, "", false, false
+	if idx := strings.Index(ref, ":-"); idx >= 0 {
+		name, defValue, hasDefault = ref[:idx], ref[idx+2:], true
+	} else if idx := strings.Index(ref, "-"); idx >= 0 {
+		name, defValue, unsetOnly, hasDefault = ref[:idx], ref[idx+1:], true, true
+	}
+	if !isEnvName(name) {
+		return "", fmt.Errorf("invalid reference ${%s}", ref)
+	}
+
+	value, ok := lookup(name)
+	if hasDefault && (!ok || (!unsetOnly && value == "")) {
+		return expandDotenv(defValue, lookup, false)
+	}
+	return value, nil
+}
+
+// closingBrace finds the brace which closes the reference, nested references are skipped
+func closingBrace(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			depth++
+			i++
+		case s[i] == '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+func isEnvName(name string) bool {
+	if name == "" || !isEnvNameStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isEnvNameChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isEnvNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isEnvNameChar(c byte) bool {
+	return isEnvNameStart(c) || (c >= '0' && c <= '9')
+}
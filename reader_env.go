@@ -2,49 +2,222 @@ package config
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/hashicorp/go-multierror"
 )
 
+const (
+	// TagEnvPrefix sets variable names prefix of the nested structure fields
+	TagEnvPrefix = "env-prefix"
+
+	// EnvFileSuffix is a suffix of the variable which points to the file with the value
+	EnvFileSuffix = "_FILE"
+	// DefaultEnvFileMaxSize limits size of the file pointed by the _FILE variable
+	DefaultEnvFileMaxSize = 64 * 1024
+
+	// envNameSkip tag value excludes the field from reading
+	envNameSkip = "-"
+	// envFileProvider is a provider of the values read from the files pointed by _FILE variables
+	envFileProvider = "env-file"
+)
+
 type EnvReader struct {
 	tag string
+	// Prefix is added to all the variable names
+	Prefix string
+	// DeriveNames turns on derivation of the variable names from the field path for the fields without tag,
+	// e.g. Database.MaxConns is read from DATABASE_MAX_CONNS
+	DeriveNames bool
+	// FileIndirection turns on reading of the value from the file pointed by FOO_FILE variable if FOO is unset
+	FileIndirection bool
+	// MaxFileSize limits size of the _FILE variable files, DefaultEnvFileMaxSize is used if it is not set
+	MaxFileSize int64
+	// Logger of the reader, LibLogger is used if it is not set
+	Logger Logger
 }
 
 // reads environment variables to the provided configuration structure
 func (r EnvReader) Read(metas []StructMeta) error {
 	var err error
 
+	logger := loggerOrDefault(r.Logger)
 	var result *multierror.Error
 	for k, meta := range metas {
-		tag, _ := meta.Tag.Lookup(r.tag)
-		if tag == "" {
+		tag := envName(meta, r.tag, r.Prefix, r.DeriveNames)
+		if tag == "" || !meta.Accepts(r.tag) {
 			continue
 		}
 
-		LibLogger(fmt.Sprintf("reading %s", tag))
+		logger.Debug("reading variable", "key", tag)
 
 		var rawValue *string
+		provider := r.tag
 
 		if value, ok := os.LookupEnv(tag); ok {
 			rawValue = &value
-		} else {
-			if !meta.DefValueProvided || Verbose {
-				result = multierror.Append(result, fmt.Errorf("%s is not set", tag))
+		} else if path, ok := os.LookupEnv(tag + EnvFileSuffix); ok && r.FileIndirection {
+			logger.Debug("reading variable file", "key", tag, "path", path)
+			if value, err = r.readFile(path); err != nil {
+				result = multierror.Append(result, newFieldError(meta, envFileProvider, tag+EnvFileSuffix, "",
+					errorCategory(err, ErrorParse), fmt.Errorf("%s%s: %w", tag, EnvFileSuffix, err)))
+				continue
 			}
+			rawValue = &value
+			provider = envFileProvider
+		} else {
+			logger.Debug("variable is not set", "key", tag)
 			continue
 		}
 
-		if err = parseValue(meta.FieldValue, *rawValue, meta.Separator, meta.Layout); err != nil {
-			result = multierror.Append(result, err)
-		} else {
-			metas[k].Provider = r.tag
+		if err = metas[k].Assign(provider, *rawValue); err != nil {
+			result = multierror.Append(result, newFieldError(meta, provider, tag, *rawValue, ErrorParse, err))
 		}
 	}
 
-	return result
+	return result.ErrorOrNil()
+}
+
+// ListSize returns the number of the list items defined by the variables, e.g. UPSTREAMS_0_HOST and UPSTREAMS_1_HOST
+func (r EnvReader) ListSize(list StructMeta) int {
+	names := make([]string, 0)
+	for _, env := range os.Environ() {
+		if idx := strings.Index(env, "="); idx > 0 {
+			names = append(names, env[:idx])
+		}
+	}
+	return envListSize(list, r.Prefix, r.DeriveNames, names)
 }
 
 func (r EnvReader) Stop() {
 	// do nothing
 }
+
+func (r EnvReader) provider() string {
+	return r.tag
+}
+
+// readFile reads the value file, surrounding whitespaces (e.g. trailing newline) are trimmed
+func (r EnvReader) readFile(path string) (string, error) {
+	maxSize := r.MaxFileSize
+	if maxSize <= 0 {
+		maxSize = DefaultEnvFileMaxSize
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > maxSize {
+		return "", fmt.Errorf("%s exceeds %d bytes limit", path, maxSize)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// envName resolves the variable name of the field, nested structures env-prefix tags are added to the name.
+// Name of the field without tag is derived from the field path if derive is set, otherwise it is empty.
+// Fields with a tag of another library reader (e.g. vault) are not derived, so they don't pick up variables
+func envName(meta StructMeta, tag, prefix string, derive bool) string {
+	name, _ := meta.Tag.Lookup(tag)
+	if name == envNameSkip || (name == "" && (!derive || hasReaderTag(meta))) {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	for _, parent := range meta.parents {
+		b.WriteString(envSegment(parent, name == ""))
+	}
+	if name == "" {
+		name = upperSnakeCase(meta.FieldName)
+	}
+	b.WriteString(name)
+
+	return b.String()
+}
+
+// envSegment returns the variable name segment of the nested structure, env-prefix tag replaces the derived one.
+// Lists items segments always contain the list name and the item index, e.g. UPSTREAMS_0_
+func envSegment(parent structParent, derive bool) string {
+	var segment string
+	if parentPrefix, ok := parent.tag.Lookup(TagEnvPrefix); ok {
+		segment = parentPrefix
+	} else if (derive || parent.index >= 0) && !parent.anonymous {
+		segment = upperSnakeCase(parent.name) + "_"
+	}
+	if parent.index >= 0 {
+		segment += strconv.Itoa(parent.index) + "_"
+	}
+	return segment
+}
+
+// envListSize returns the number of list items defined by the variables, it is the max item index + 1.
+// Items variables could be named with or without derived segments, so both prefixes are checked
+func envListSize(list StructMeta, prefix string, derive bool, names []string) int {
+	prefixes := []string{envListPrefix(list, prefix, false)}
+	if derive {
+		prefixes = append(prefixes, envListPrefix(list, prefix, true))
+	}
+
+	size := -1
+	for _, name := range names {
+		for _, p := range prefixes {
+			if !strings.HasPrefix(name, p) {
+				continue
+			}
+			rest := name[len(p):]
+			idx := strings.Index(rest, "_")
+			if idx <= 0 {
+				continue
+			}
+			if index, err := strconv.Atoi(rest[:idx]); err == nil && index+1 > size {
+				size = index + 1
+			}
+		}
+	}
+	return size
+}
+
+// envListPrefix returns the variables prefix of the list items, e.g. APP_UPSTREAMS_
+func envListPrefix(list StructMeta, prefix string, derive bool) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	for _, parent := range list.parents {
+		b.WriteString(envSegment(parent, derive))
+	}
+	if listPrefix, ok := list.Tag.Lookup(TagEnvPrefix); ok {
+		b.WriteString(listPrefix)
+	} else {
+		b.WriteString(upperSnakeCase(list.FieldName) + "_")
+	}
+	return b.String()
+}
+
+// upperSnakeCase converts field name to the variable name, e.g. MaxConns to MAX_CONNS and HTTPPort to HTTP_PORT
+func upperSnakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
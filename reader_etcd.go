@@ -0,0 +1,519 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	// etcdRetryDelay is a delay between failed watch requests
+	etcdRetryDelay = 5 * time.Second
+	// etcdMaxTxnOps is the default limit of the operations per transaction (--max-txn-ops)
+	etcdMaxTxnOps = 128
+)
+
+type (
+	// EtcdReader reads etcd v3 keys by the JSON gateway. If the prefix is set, all the keys under the prefix are read
+	// by a single range request per refresh, otherwise the tagged keys are read by a single transaction.
+	// Changes of the prefix or the keys are watched by /v3/watch stream
+	EtcdReader struct {
+		endpoint string
+		prefix   string
+		tag      string
+		state    *etcdState
+		// Client is a HTTP client of the requests, e.g. with TLS settings.
+		// Its Timeout is not applied to the watch stream, the stream is limited by the reader context
+		Client *http.Client
+		// Username and Password turn on authentication by /v3/auth/authenticate
+		Username string
+		Password string
+		// Logger of the reader, LibLogger is used if it is not set
+		Logger Logger
+	}
+
+	// etcdState keeps the watched ranges, the auth token and the watch stream of the reader
+	etcdState struct {
+		mu       sync.Mutex
+		ranges   []etcdRange
+		revision int64
+		token    string
+		watching bool
+		ctx      context.Context
+		cancel   context.CancelFunc
+		// cancelStream restarts the watch stream, e.g. once the range is changed
+		cancelStream context.CancelFunc
+		wg           sync.WaitGroup
+		notify       chan struct{}
+	}
+
+	etcdKeyValue struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+	}
+
+	etcdHeader struct {
+		Revision int64 `json:"revision,string"`
+	}
+
+	// etcdRange is a range request, the single key is requested if range end is empty
+	etcdRange struct {
+		Key      []byte `json:"key"`
+		RangeEnd []byte `json:"range_end,omitempty"`
+	}
+
+	etcdRangeResponse struct {
+		Header etcdHeader     `json:"header"`
+		Kvs    []etcdKeyValue `json:"kvs"`
+	}
+
+	etcdTxnRequest struct {
+		Success []etcdRequestOp `json:"success"`
+	}
+
+	etcdRequestOp struct {
+		RequestRange etcdRange `json:"request_range"`
+	}
+
+	etcdTxnResponse struct {
+		Header    etcdHeader `json:"header"`
+		Responses []struct {
+			ResponseRange etcdRangeResponse `json:"response_range"`
+		} `json:"responses"`
+	}
+
+	etcdWatchRequest struct {
+		CreateRequest etcdWatchCreateRequest `json:"create_request"`
+	}
+
+	etcdWatchCreateRequest struct {
+		Key           []byte `json:"key"`
+		RangeEnd      []byte `json:"range_end,omitempty"`
+		StartRevision int64  `json:"start_revision,omitempty"`
+	}
+
+	// etcdWatchMessage is a message of the watch stream
+	etcdWatchMessage struct {
+		Result *struct {
+			Header          etcdHeader `json:"header"`
+			Canceled        bool       `json:"canceled"`
+			CompactRevision int64      `json:"compact_revision,string"`
+			Events          []struct {
+				Type string `json:"type"`
+			} `json:"events"`
+		} `json:"result"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+)
+
+// reads etcd keys to the provided configuration structure
+func (r EtcdReader) Read(metas []StructMeta) error {
+	return r.ReadContext(context.Background(), metas)
+}
+
+// ReadContext reads etcd keys, cancellation of the context interrupts requests
+func (r EtcdReader) ReadContext(ctx context.Context, metas []StructMeta) error {
+	logger := loggerOrDefault(r.Logger)
+	keys := make(map[int]string)
+	unique := make(map[string]bool)
+	for k, meta := range metas {
+		tag, _ := meta.Tag.Lookup(r.tag)
+		// keys of the list items are not supported
+		if tag == "" || meta.inList() || !meta.Accepts(r.tag) {
+			continue
+		}
+		key := r.prefix + tag
+		keys[k] = key
+		unique[key] = true
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// the prefix is read as a whole, otherwise only the tagged keys are read,
+	// so the reader never reads or watches unrelated parts of the keyspace
+	var ranges []etcdRange
+	if r.prefix != "" {
+		ranges = []etcdRange{{Key: []byte(r.prefix), RangeEnd: etcdPrefixEnd(r.prefix)}}
+	} else {
+		for key := range unique {
+			ranges = append(ranges, etcdRange{Key: []byte(key)})
+		}
+		sort.Slice(ranges, func(i, j int) bool {
+			return string(ranges[i].Key) < string(ranges[j].Key)
+		})
+	}
+
+	values, revision, err := r.read(ctx, ranges)
+	if err != nil {
+		return err
+	}
+	r.state.track(ranges, revision)
+
+	var result *multierror.Error
+	for k, key := range keys {
+		meta := metas[k]
+		value, ok := values[key]
+		if !ok {
+			logger.Debug("key is not set", "key", key)
+			continue
+		}
+		if err := metas[k].Assign(r.tag, value); err != nil {
+			result = multierror.Append(result, newFieldError(meta, r.tag, key, value, ErrorParse, err))
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+// read reads the prefix range or the keys by transactions, it returns values by the keys and the revision they have been read at
+func (r EtcdReader) read(ctx context.Context, ranges []etcdRange) (map[string]string, int64, error) {
+	values := make(map[string]string)
+	if r.prefix != "" {
+		loggerOrDefault(r.Logger).Debug("reading prefix", "prefix", r.prefix)
+		var resp etcdRangeResponse
+		if err := r.post(ctx, "/v3/kv/range", ranges[0], &resp); err != nil {
+			return nil, 0, err
+		}
+		for _, kv := range resp.Kvs {
+			values[string(kv.Key)] = string(kv.Value)
+		}
+		return values, resp.Header.Revision, nil
+	}
+
+	var revision int64
+	for start := 0; start < len(ranges); start += etcdMaxTxnOps {
+		end := start + etcdMaxTxnOps
+		if end > len(ranges) {
+			end = len(ranges)
+		}
+		loggerOrDefault(r.Logger).Debug("reading keys", "count", end-start)
+		req := etcdTxnRequest{Success: make([]etcdRequestOp, 0, end-start)}
+		for _, rng := range ranges[start:end] {
+			req.Success = append(req.Success, etcdRequestOp{RequestRange: rng})
+		}
+		var resp etcdTxnResponse
+		if err := r.post(ctx, "/v3/kv/txn", req, &resp); err != nil {
+			return nil, 0, err
+		}
+		for _, op := range resp.Responses {
+			for _, kv := range op.ResponseRange.Kvs {
+				values[string(kv.Key)] = string(kv.Value)
+			}
+		}
+		// changes after the earliest revision are watched, so nothing is missed between transactions
+		if revision == 0 || resp.Header.Revision < revision {
+			revision = resp.Header.Revision
+		}
+	}
+	return values, revision, nil
+}
+
+// Watch runs the watch stream of the prefix or the keys, every change is notified
+func (r EtcdReader) Watch() (<-chan struct{}, error) {
+	return r.state.watch(r), nil
+}
+
+// Stop the watch stream, it waits until the stream is closed
+func (r EtcdReader) Stop() {
+	r.state.stop()
+}
+
+func (r EtcdReader) provider() string {
+	return r.tag
+}
+
+// post sends gateway request, the reader authenticates if the token is missing or expired
+func (r EtcdReader) post(ctx context.Context, path string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := r.do(ctx, r.client(), path, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err = etcdStatusError(path, resp); err != nil {
+		return err
+	}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("etcd %s: %w", path, err)
+	}
+	return nil
+}
+
+// do sends gateway request by the client, it authenticates and retries once on the unauthorized response
+func (r EtcdReader) do(ctx context.Context, client *http.Client, path string, data []byte) (*http.Response, error) {
+	var err error
+	for attempt := 0; ; attempt++ {
+		token := r.state.authToken()
+		if token == "" && r.Username != "" {
+			if token, err = r.authenticate(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(r.endpoint, "/")+path, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("etcd %s: %w", path, err)
+		}
+		// token could be expired
+		if resp.StatusCode == http.StatusUnauthorized && r.Username != "" && attempt == 0 {
+			_ = resp.Body.Close()
+			r.state.setToken("")
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// authenticate requests a new token by username and password
+func (r EtcdReader) authenticate(ctx context.Context) (string, error) {
+	data, err := json.Marshal(map[string]string{"name": r.Username, "password": r.Password})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(r.endpoint, "/")+"/v3/auth/authenticate", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client().Do(req)
+	if err != nil {
+		return "", withCategory(ErrorAuth, fmt.Errorf("etcd authentication: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", withCategory(ErrorAuth, fmt.Errorf("etcd authentication: %s", resp.Status))
+	}
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&auth); err != nil || auth.Token == "" {
+		return "", withCategory(ErrorAuth, fmt.Errorf("etcd authentication: no token in response: %v", err))
+	}
+
+	r.state.setToken(auth.Token)
+	return auth.Token, nil
+}
+
+// stream runs the watch stream of the ranges until it is failed or the context is cancelled,
+// a watcher is created per range in the same stream. It returns the revision the next stream should be started from
+func (r EtcdReader) stream(ctx context.Context, ranges []etcdRange, revision int64) (int64, error) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, rng := range ranges {
+		req := etcdWatchRequest{CreateRequest: etcdWatchCreateRequest{Key: rng.Key, RangeEnd: rng.RangeEnd}}
+		if revision > 0 {
+			req.CreateRequest.StartRevision = revision + 1
+		}
+		if err := encoder.Encode(req); err != nil {
+			return revision, err
+		}
+	}
+	resp, err := r.do(ctx, longPollClient(r.client()), "/v3/watch", body.Bytes())
+	if err != nil {
+		return revision, err
+	}
+	defer resp.Body.Close()
+	if err = etcdStatusError("/v3/watch", resp); err != nil {
+		return revision, err
+	}
+
+	logger := loggerOrDefault(r.Logger)
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg etcdWatchMessage
+		if err = decoder.Decode(&msg); err != nil {
+			return revision, err
+		}
+		if msg.Error != nil {
+			return revision, fmt.Errorf("etcd watch: %s", msg.Error.Message)
+		}
+		if msg.Result == nil {
+			continue
+		}
+		if msg.Result.Canceled {
+			// revision has been compacted, so the range should be read again
+			if msg.Result.CompactRevision > 0 {
+				r.state.notifyChange()
+				return 0, fmt.Errorf("etcd watch: revision %d has been compacted", revision)
+			}
+			return revision, fmt.Errorf("etcd watch has been cancelled")
+		}
+		if msg.Result.Header.Revision > revision {
+			revision = msg.Result.Header.Revision
+		}
+		if len(msg.Result.Events) > 0 {
+			logger.Debug("etcd keys changed", "revision", revision)
+			r.state.notifyChange()
+		}
+	}
+}
+
+func (r EtcdReader) client() *http.Client {
+	if r.Client == nil {
+		return http.DefaultClient
+	}
+	return r.Client
+}
+
+func (st *etcdState) authToken() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.token
+}
+
+func (st *etcdState) setToken(token string) {
+	st.mu.Lock()
+	st.token = token
+	st.mu.Unlock()
+}
+
+// track keeps the ranges and the revision they have been read at, the watch stream is restarted if the ranges are changed
+func (st *etcdState) track(ranges []etcdRange, revision int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if !equalRanges(st.ranges, ranges) && st.cancelStream != nil {
+		st.cancelStream()
+	}
+	st.ranges, st.revision = ranges, revision
+}
+
+// watch starts the watch loop once
+func (st *etcdState) watch(r EtcdReader) <-chan struct{} {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if !st.watching {
+		st.ctx, st.cancel = context.WithCancel(context.Background())
+		st.watching = true
+		st.wg.Add(1)
+		go st.loop(st.ctx, r)
+	}
+	return st.notify
+}
+
+// loop runs watch streams of the tracked ranges until the context is cancelled, failed streams are restarted
+func (st *etcdState) loop(ctx context.Context, r EtcdReader) {
+	defer st.wg.Done()
+
+	logger := loggerOrDefault(r.Logger)
+	for {
+		st.mu.Lock()
+		ranges, revision := st.ranges, st.revision
+		streamCtx, cancel := context.WithCancel(ctx)
+		st.cancelStream = cancel
+		st.mu.Unlock()
+
+		var err error
+		if len(ranges) > 0 {
+			revision, err = r.stream(streamCtx, ranges, revision)
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		st.mu.Lock()
+		restarted := !equalRanges(st.ranges, ranges)
+		// compacted revision is reset, so the next stream starts from the current one
+		if !restarted && (revision == 0 || revision > st.revision) {
+			st.revision = revision
+		}
+		st.mu.Unlock()
+		if restarted {
+			continue
+		}
+
+		if err != nil {
+			logger.Warn("etcd watch failed", "prefix", r.prefix, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(etcdRetryDelay):
+		}
+	}
+}
+
+func (st *etcdState) notifyChange() {
+	select {
+	case st.notify <- struct{}{}:
+	default:
+	}
+}
+
+// stop the watch loop
+func (st *etcdState) stop() {
+	st.mu.Lock()
+	if st.cancel != nil {
+		st.cancel()
+		st.cancel = nil
+	}
+	st.watching = false
+	st.mu.Unlock()
+	st.wg.Wait()
+}
+
+// etcdStatusError classifies unsuccessful gateway response
+func etcdStatusError(path string, resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return withCategory(ErrorAuth, fmt.Errorf("etcd %s: %s", path, resp.Status))
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return withCategory(ErrorTransport, fmt.Errorf("etcd %s: %s", path, resp.Status))
+	}
+	return fmt.Errorf("etcd %s: %s", path, resp.Status)
+}
+
+// etcdPrefixEnd returns the range end of the keys with the prefix, it is the prefix with the last byte incremented
+func etcdPrefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// all the keys are greater than the prefix of 0xff bytes
+	return []byte{0}
+}
+
+func equalRanges(a, b []etcdRange) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i].Key, b[i].Key) || !bytes.Equal(a[i].RangeEnd, b[i].RangeEnd) {
+			return false
+		}
+	}
+	return true
+}
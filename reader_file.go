@@ -0,0 +1,303 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/hashicorp/go-multierror"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	FileFormatJSON = "json"
+	FileFormatYAML = "yaml"
+	FileFormatTOML = "toml"
+
+	// FileKeySeparator separates nested keys in the file tag
+	FileKeySeparator = "."
+)
+
+type FileReader struct {
+	path     string
+	format   string
+	tag      string
+	watcher  *fileWatcher
+	snapshot *sourceSnapshot
+	// Logger of the reader, LibLogger is used if it is not set
+	Logger Logger
+}
+
+// reads file document to the provided configuration structure
+func (r FileReader) Read(metas []StructMeta) error {
+	document, err := r.document()
+	if err != nil {
+		return err
+	}
+
+	logger := loggerOrDefault(r.Logger)
+	var result *multierror.Error
+	for k, meta := range metas {
+		tag := fileKey(meta, r.tag)
+		if tag == "" || !meta.Accepts(r.tag) {
+			continue
+		}
+
+		logger.Debug("reading key", "path", r.path, "key", tag)
+
+		val, ok := lookupDocument(document, tag)
+		if !ok {
+			logger.Debug("key is not set", "path", r.path, "key", tag)
+			continue
+		}
+
+		rawValue, err := documentValueToString(val, meta.Separator, meta.Layout)
+		if err != nil {
+			result = multierror.Append(result, newFieldError(meta, r.path, tag, "", ErrorParse, fmt.Errorf("%s: %w", tag, err)))
+			continue
+		}
+
+		if err = metas[k].Assign(r.path, rawValue); err != nil {
+			result = multierror.Append(result, newFieldError(meta, r.path, tag, rawValue, ErrorParse, err))
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+// Watch notifies about file changes
+func (r FileReader) Watch() (<-chan struct{}, error) {
+	return r.watcher.Watch(loggerOrDefault(r.Logger))
+}
+
+// Prepare reads the document of the refresh, ListSize and the following Read use it
+func (r FileReader) Prepare(context.Context) error {
+	document, err := r.load()
+	if err != nil {
+		return err
+	}
+	r.snapshot.set(document)
+	return nil
+}
+
+// ListSize returns the number of the document list items
+func (r FileReader) ListSize(list StructMeta) int {
+	key := fileKey(list, r.tag)
+	if key == "" {
+		return -1
+	}
+	document, _ := r.snapshot.current().(map[string]interface{})
+	if document == nil {
+		var err error
+		if document, err = r.load(); err != nil {
+			return -1
+		}
+	}
+	val, ok := lookupDocument(document, key)
+	if !ok {
+		return -1
+	}
+	if items := reflect.ValueOf(val); items.Kind() == reflect.Slice {
+		return items.Len()
+	}
+	return -1
+}
+
+func (r FileReader) Stop() {
+	r.watcher.Stop()
+}
+
+func (r FileReader) provider() string {
+	return r.path
+}
+
+// document returns the prepared document or reads it if the reader is not prepared
+func (r FileReader) document() (map[string]interface{}, error) {
+	if document, ok := r.snapshot.take().(map[string]interface{}); ok {
+		return document, nil
+	}
+	return r.load()
+}
+
+// load reads and decodes file into a generic document
+func (r FileReader) load() (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDocument(data, r.format)
+}
+
+// fileFormat detects document format by the file extension
+func fileFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FileFormatYAML
+	case ".toml":
+		return FileFormatTOML
+	default:
+		return FileFormatJSON
+	}
+}
+
+// decodeDocument decodes raw data of the given format into a generic document
+func decodeDocument(data []byte, format string) (map[string]interface{}, error) {
+	document := make(map[string]interface{})
+
+	switch format {
+	case FileFormatJSON:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err != nil {
+			return nil, withCategory(ErrorParse, err)
+		}
+	case FileFormatYAML:
+		var raw map[interface{}]interface{}
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, withCategory(ErrorParse, err)
+		}
+		document = normalizeYaml(raw).(map[string]interface{})
+	case FileFormatTOML:
+		if _, err := toml.Decode(string(data), &document); err != nil {
+			return nil, withCategory(ErrorParse, err)
+		}
+	default:
+		return nil, withCategory(ErrorParse, fmt.Errorf("unsupported file format %q", format))
+	}
+
+	return document, nil
+}
+
+// normalizeYaml converts yaml maps to the string keyed maps
+func normalizeYaml(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprintf("%v", key)] = normalizeYaml(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range v {
+			v[i] = normalizeYaml(val)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// lookupDocument searches the value by dotted key in the nested document, numeric parts are list indexes
+func lookupDocument(document map[string]interface{}, key string) (interface{}, bool) {
+	return lookupParts(document, strings.Split(key, FileKeySeparator))
+}
+
+// lookupParts searches the value by key parts in the nested document, numeric parts are list indexes
+func lookupParts(document map[string]interface{}, parts []string) (interface{}, bool) {
+	var current interface{} = document
+	for _, part := range parts {
+		if list := reflect.ValueOf(current); list.Kind() == reflect.Slice {
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= list.Len() {
+				return nil, false
+			}
+			current = list.Index(index).Interface()
+			continue
+		}
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// fileKey resolves the document key of the field, keys of the list items fields are relative to the item,
+// e.g. host field of the upstreams list item is upstreams.0.host
+func fileKey(meta StructMeta, tag string) string {
+	key, _ := meta.Tag.Lookup(tag)
+	if key == "" {
+		return ""
+	}
+
+	var prefix string
+	for _, parent := range meta.parents {
+		if parent.index < 0 {
+			continue
+		}
+		listKey, _ := parent.tag.Lookup(tag)
+		if listKey == "" {
+			return ""
+		}
+		prefix += listKey + FileKeySeparator + strconv.Itoa(parent.index) + FileKeySeparator
+	}
+	return prefix + key
+}
+
+// documentValueToString converts decoded document value to the raw string,
+// lists and maps are joined by the provided separator, so they can be parsed by parseValue
+func documentValueToString(value interface{}, sep, layout string) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), nil
+	case time.Time:
+		if layout == "" {
+			layout = time.RFC3339Nano
+		}
+		return v.Format(layout), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, key := range keys {
+			val, err := documentValueToString(v[key], sep, layout)
+			if err != nil {
+				return "", err
+			}
+			pairs[i] = key + ":" + val
+		}
+		return strings.Join(pairs, sep), nil
+	}
+
+	// lists could be decoded into different slice types (e.g. toml)
+	if rv := reflect.ValueOf(value); rv.Kind() == reflect.Slice {
+		items := make([]string, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			item := rv.Index(i).Interface()
+			if reflect.ValueOf(item).Kind() == reflect.Map || reflect.ValueOf(item).Kind() == reflect.Slice {
+				return "", fmt.Errorf("nested lists are not supported")
+			}
+			val, err := documentValueToString(item, sep, layout)
+			if err != nil {
+				return "", err
+			}
+			items[i] = val
+		}
+		return strings.Join(items, sep), nil
+	}
+
+	return fmt.Sprintf("%v", value), nil
+}
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+type (
+	FlagReader struct {
+		flagSet *flag.FlagSet
+		args    []string
+		tag     string
+		state   *flagState
+		// Logger of the reader, LibLogger is used if it is not set
+		Logger Logger
+	}
+
+	// flagState keeps raw values of the flags which have been set, flags are registered and parsed once
+	flagState struct {
+		mu     sync.Mutex
+		parsed bool
+		err    error
+		values map[string]string
+	}
+
+	// flagValue keeps raw flag value, repeated flags of the slices and maps are joined by the field separator,
+	// the last one wins otherwise
+	flagValue struct {
+		separator string
+		defValue  string
+		isBool    bool
+		multi     bool
+		raw       []string
+	}
+)
+
+// reads command-line flags to the provided configuration structure,
+// only flags which have been set are assigned
+func (r FlagReader) Read(metas []StructMeta) error {
+	values, err := r.parse(metas)
+	if err != nil {
+		return err
+	}
+
+	logger := loggerOrDefault(r.Logger)
+	var result *multierror.Error
+	for k, meta := range metas {
+		tag, _ := meta.Tag.Lookup(r.tag)
+		// flags are not able to address list items
+		if tag == "" || meta.inList() || !meta.Accepts(r.tag) {
+			continue
+		}
+
+		value, ok := values[tag]
+		if !ok {
+			continue
+		}
+
+		logger.Debug("reading flag", "key", "-"+tag)
+
+		if err = metas[k].Assign(r.tag, value); err != nil {
+			result = multierror.Append(result, newFieldError(meta, r.tag, "-"+tag, value, ErrorParse, fmt.Errorf("-%s: %w", tag, err)))
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+func (r FlagReader) Stop() {
+	// do nothing
+}
+
+func (r FlagReader) provider() string {
+	return r.tag
+}
+
+// parse registers a flag for every tagged field and parses arguments. Flags which have been registered
+// in the flag set already (e.g. by the application) are not registered again, but their values are read as well
+func (r FlagReader) parse(metas []StructMeta) (map[string]string, error) {
+	r.state.mu.Lock()
+	defer r.state.mu.Unlock()
+
+	if r.state.parsed {
+		return r.state.values, r.state.err
+	}
+
+	for _, meta := range metas {
+		tag, _ := meta.Tag.Lookup(r.tag)
+		// fields restricted to other readers are not registered as flags
+		if tag == "" || meta.inList() || !meta.allows(r.tag) || r.flagSet.Lookup(tag) != nil {
+			continue
+		}
+		kind := indirectType(meta.FieldValue.Type()).Kind()
+		value := &flagValue{
+			separator: meta.Separator,
+			isBool:    kind == reflect.Bool,
+			multi:     kind == reflect.Slice || kind == reflect.Map,
+		}
+		// secrets defaults are not shown in usage
+		if !meta.NotLogging {
+			value.defValue = meta.DefValue
+		}
+		r.flagSet.Var(value, tag, meta.Description)
+	}
+
+	r.state.parsed = true
+	r.state.err = withCategory(ErrorParse, r.flagSet.Parse(r.args))
+	// only flags which have been set are visited
+	r.flagSet.Visit(func(f *flag.Flag) {
+		r.state.values[f.Name] = f.Value.String()
+	})
+
+	return r.state.values, r.state.err
+}
+
+func (v *flagValue) String() string {
+	if v == nil {
+		return ""
+	}
+	if len(v.raw) == 0 {
+		return v.defValue
+	}
+	return strings.Join(v.raw, v.separator)
+}
+
+func (v *flagValue) Set(value string) error {
+	if v.multi {
+		v.raw = append(v.raw, value)
+	} else {
+		v.raw = []string{value}
+	}
+	return nil
+}
+
+// IsBoolFlag allows to set boolean fields without value (e.g. -debug)
+func (v *flagValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+// indirectType unwraps pointer types
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
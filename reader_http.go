@@ -0,0 +1,251 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+type (
+	// HTTPReader reads JSON document by URL, fields are mapped by dotted keys (e.g. db.host)
+	// or JSON pointers (e.g. /db/host) of the http tag. The document is requested with If-None-Match header,
+	// so unchanged document is not parsed on every refresh. The last good document is used on transport failures
+	HTTPReader struct {
+		url   string
+		tag   string
+		state *httpState
+		// Client is a HTTP client of the requests, e.g. with mTLS settings
+		Client *http.Client
+		// Header is added to every request
+		Header http.Header
+		// BearerToken is sent by Authorization header
+		BearerToken string
+		// Logger of the reader, LibLogger is used if it is not set
+		Logger Logger
+	}
+
+	// httpState keeps the last good document and its ETag
+	httpState struct {
+		mu       sync.Mutex
+		etag     string
+		document map[string]interface{}
+		snapshot sourceSnapshot
+	}
+)
+
+// reads HTTP document to the provided configuration structure
+func (r HTTPReader) Read(metas []StructMeta) error {
+	return r.ReadContext(context.Background(), metas)
+}
+
+// ReadContext reads HTTP document, cancellation of the context interrupts the request
+func (r HTTPReader) ReadContext(ctx context.Context, metas []StructMeta) error {
+	document, _ := r.state.snapshot.take().(map[string]interface{})
+	if document == nil {
+		var err error
+		if document, err = r.load(ctx); err != nil {
+			return err
+		}
+	}
+
+	logger := loggerOrDefault(r.Logger)
+	var result *multierror.Error
+	for k, meta := range metas {
+		key, parts := httpKey(meta, r.tag)
+		if key == "" || !meta.Accepts(r.tag) {
+			continue
+		}
+
+		val, ok := lookupParts(document, parts)
+		if !ok {
+			logger.Debug("key is not set", "url", r.url, "key", key)
+			continue
+		}
+
+		rawValue, err := documentValueToString(val, meta.Separator, meta.Layout)
+		if err != nil {
+			result = multierror.Append(result, newFieldError(meta, r.url, key, "", ErrorParse, fmt.Errorf("%s: %w", key, err)))
+			continue
+		}
+
+		if err = metas[k].Assign(r.url, rawValue); err != nil {
+			result = multierror.Append(result, newFieldError(meta, r.url, key, rawValue, ErrorParse, err))
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+// Prepare loads the document of the refresh, ListSize and the following Read use it
+func (r HTTPReader) Prepare(ctx context.Context) error {
+	document, err := r.load(ctx)
+	if err != nil {
+		return err
+	}
+	r.state.snapshot.set(document)
+	return nil
+}
+
+// ListSize returns the number of the list items of the document loaded by Prepare
+func (r HTTPReader) ListSize(list StructMeta) int {
+	key, parts := httpKey(list, r.tag)
+	if key == "" {
+		return -1
+	}
+	document, _ := r.state.snapshot.current().(map[string]interface{})
+	if document == nil {
+		return -1
+	}
+	val, ok := lookupParts(document, parts)
+	if !ok {
+		return -1
+	}
+	if items := reflect.ValueOf(val); items.Kind() == reflect.Slice {
+		return items.Len()
+	}
+	return -1
+}
+
+func (r HTTPReader) Stop() {
+	// do nothing
+}
+
+func (r HTTPReader) provider() string {
+	return r.url
+}
+
+// load requests the document, the cached document is returned if it is not modified
+// or if the request is failed by transport reasons
+func (r HTTPReader) load(ctx context.Context) (map[string]interface{}, error) {
+	etag, cached := r.state.get()
+
+	document, nextETag, err := r.fetch(ctx, etag)
+	if err != nil {
+		if cached != nil && errorCategory(err, ErrorParse) == ErrorTransport {
+			loggerOrDefault(r.Logger).Warn("http request failed, last good document is used", "url", r.url, "error", err)
+			return cached, nil
+		}
+		return nil, err
+	}
+	if document == nil {
+		loggerOrDefault(r.Logger).Debug("http document is not modified", "url", r.url, "etag", etag)
+		return cached, nil
+	}
+
+	r.state.set(nextETag, document)
+	return document, nil
+}
+
+// fetch requests the document, nil document is returned if it is not modified since etag
+func (r HTTPReader) fetch(ctx context.Context, etag string) (map[string]interface{}, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for name, values := range r.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	req.Header.Set("Accept", "application/json")
+	if r.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+r.BearerToken)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("http %s: %w", r.url, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && etag != "":
+		return nil, etag, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, "", withCategory(ErrorAuth, fmt.Errorf("http %s: %s", r.url, resp.Status))
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return nil, "", withCategory(ErrorTransport, fmt.Errorf("http %s: %s", r.url, resp.Status))
+	case resp.StatusCode != http.StatusOK:
+		return nil, "", fmt.Errorf("http %s: %s", r.url, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		// the body could be interrupted by the connection failure
+		return nil, "", withCategory(ErrorTransport, fmt.Errorf("http %s: %w", r.url, err))
+	}
+	document, err := decodeDocument(data, FileFormatJSON)
+	if err != nil {
+		return nil, "", fmt.Errorf("http %s: %w", r.url, err)
+	}
+	return document, resp.Header.Get("ETag"), nil
+}
+
+func (st *httpState) get() (string, map[string]interface{}) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.etag, st.document
+}
+
+func (st *httpState) set(etag string, document map[string]interface{}) {
+	st.mu.Lock()
+	st.etag, st.document = etag, document
+	st.mu.Unlock()
+}
+
+// httpKey resolves the document key of the field and its parts, keys of the list items fields are relative to the item,
+// e.g. host field of the upstreams list item is upstreams.0.host or /upstreams/0/host
+func httpKey(meta StructMeta, tag string) (string, []string) {
+	key, _ := meta.Tag.Lookup(tag)
+	if key == "" {
+		return "", nil
+	}
+
+	var parts []string
+	for _, parent := range meta.parents {
+		if parent.index < 0 {
+			continue
+		}
+		listKey, _ := parent.tag.Lookup(tag)
+		if listKey == "" {
+			return "", nil
+		}
+		parts = append(append(parts, keyParts(listKey)...), strconv.Itoa(parent.index))
+	}
+	parts = append(parts, keyParts(key)...)
+
+	if strings.HasPrefix(key, "/") {
+		escaped := make([]string, len(parts))
+		for i, part := range parts {
+			escaped[i] = strings.NewReplacer("~", "~0", "/", "~1").Replace(part)
+		}
+		return "/" + strings.Join(escaped, "/"), parts
+	}
+	return strings.Join(parts, FileKeySeparator), parts
+}
+
+// keyParts splits JSON pointer (RFC 6901) or dotted key
+func keyParts(key string) []string {
+	if !strings.HasPrefix(key, "/") {
+		return strings.Split(key, FileKeySeparator)
+	}
+	parts := strings.Split(key[1:], "/")
+	for i, part := range parts {
+		parts[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+	}
+	return parts
+}
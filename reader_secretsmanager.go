@@ -0,0 +1,167 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	// DefaultVersionStage is a version stage of the secrets which is read if the stage is not set
+	DefaultVersionStage = "AWSCURRENT"
+
+	// secretARNParts is the number of ARN parts up to the secret name, e.g. arn:aws:secretsmanager:region:account:secret:name
+	secretARNParts = 7
+	// secretStageLabel is a prefix of the custom stage of the tag, e.g. "app/db:password@stage=blue"
+	secretStageLabel = "stage="
+	// secretAWSStagePrefix is a prefix of the AWS managed stages, e.g. AWSPREVIOUS
+	secretAWSStagePrefix = "AWS"
+)
+
+// SecretsManagerReader reads AWS Secrets Manager secrets by "secret:key@stage" tag, the key is a dotted key
+// of the JSON secret (the whole secret string is read if it is omitted), the stage is DefaultVersionStage by default.
+// The stage is either an AWS managed one (e.g. @AWSPREVIOUS) or a custom one set by @stage=label, so secret names
+// could contain @
+type SecretsManagerReader struct {
+	client secretsmanageriface.SecretsManagerAPI
+	tag    string
+	// VersionStage of the secrets without stage in the tag
+	VersionStage string
+	// Logger of the reader, LibLogger is used if it is not set
+	Logger Logger
+}
+
+// reads secrets to the provided configuration structure
+func (r SecretsManagerReader) Read(metas []StructMeta) error {
+	return r.ReadContext(context.Background(), metas)
+}
+
+// ReadContext reads secrets, cancellation of the context interrupts requests
+func (r SecretsManagerReader) ReadContext(ctx context.Context, metas []StructMeta) error {
+	logger := loggerOrDefault(r.Logger)
+	// secrets are read once per refresh by id and stage, failures are kept as well
+	secrets := make(map[string]string)
+	failures := make(map[string]error)
+
+	var result *multierror.Error
+	for k, meta := range metas {
+		tag, _ := meta.Tag.Lookup(r.tag)
+		// secrets of the list items are not supported
+		if tag == "" || meta.inList() || !meta.Accepts(r.tag) {
+			continue
+		}
+		secretID, key, stage := splitSecretTag(tag)
+		if stage == "" {
+			stage = r.VersionStage
+		}
+		if stage == "" {
+			stage = DefaultVersionStage
+		}
+
+		memoKey := secretID + "@" + stage
+		secret, ok := secrets[memoKey]
+		err, failed := failures[memoKey]
+		if !ok && !failed {
+			logger.Debug("reading secret", "key", secretID, "stage", stage)
+			if secret, err = r.secret(ctx, secretID, stage); err != nil {
+				failures[memoKey] = err
+			} else {
+				secrets[memoKey] = secret
+			}
+		}
+		if err != nil {
+			// failures other than missing secrets are reported by the reader
+			if category := errorCategory(err, ErrorParse); category != ErrorMissing {
+				result = multierror.Append(result, newFieldError(meta, r.tag, tag, "", category, err))
+			} else {
+				logger.Debug("secret is not set", "key", tag, "error", err)
+			}
+			continue
+		}
+
+		value := secret
+		if key != "" {
+			if value, err = secretKey(secret, key, meta.Separator, meta.Layout); err != nil {
+				if errorCategory(err, ErrorParse) == ErrorMissing {
+					logger.Debug("secret key is not set", "key", tag)
+				} else {
+					result = multierror.Append(result, newFieldError(meta, r.tag, tag, "", ErrorParse, err))
+				}
+				continue
+			}
+		}
+
+		if err := metas[k].Assign(r.tag, value); err != nil {
+			result = multierror.Append(result, newFieldError(meta, r.tag, tag, value, ErrorParse, err))
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+func (r SecretsManagerReader) Stop() {
+	// do nothing
+}
+
+func (r SecretsManagerReader) provider() string {
+	return r.tag
+}
+
+// secret reads the secret string of the version stage, binary secrets are returned as is
+func (r SecretsManagerReader) secret(ctx context.Context, secretID, stage string) (string, error) {
+	out, err := r.client.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId:     aws.String(secretID),
+		VersionStage: aws.String(stage),
+	})
+	if err != nil {
+		return "", err
+	}
+	if out.SecretString != nil {
+		return aws.StringValue(out.SecretString), nil
+	}
+	return string(out.SecretBinary), nil
+}
+
+// secretKey extracts the dotted key of the JSON secret
+func secretKey(secret, key, sep, layout string) (string, error) {
+	document := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(secret), &document); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object: %w", err)
+	}
+	value, ok := lookupDocument(document, key)
+	if !ok {
+		return "", withCategory(ErrorMissing, fmt.Errorf("%s is not set", key))
+	}
+	return documentValueToString(value, sep, layout)
+}
+
+// splitSecretTag splits "secret:key@stage" tag, the secret could be an ARN which contains colons.
+// The suffix is a stage only if it is an AWS managed stage or a stage= label, otherwise @ is a part of the name
+func splitSecretTag(tag string) (string, string, string) {
+	var stage string
+	if idx := strings.LastIndex(tag, "@"); idx >= 0 {
+		suffix := tag[idx+1:]
+		switch {
+		case strings.HasPrefix(suffix, secretStageLabel):
+			tag, stage = tag[:idx], strings.TrimPrefix(suffix, secretStageLabel)
+		case strings.HasPrefix(suffix, secretAWSStagePrefix) && !strings.Contains(suffix, ":"):
+			tag, stage = tag[:idx], suffix
+		}
+	}
+
+	parts := 1
+	if strings.HasPrefix(tag, "arn:") {
+		parts = secretARNParts
+	}
+	fields := strings.SplitN(tag, ":", parts+1)
+	if len(fields) <= parts {
+		return tag, "", stage
+	}
+	return strings.Join(fields[:parts], ":"), fields[parts], stage
+}
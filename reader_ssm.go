@@ -0,0 +1,140 @@
+package config
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/hashicorp/go-multierror"
+)
+
+// ssmMaxNames is a limit of the names of GetParameters request
+const ssmMaxNames = 10
+
+// SSMReader reads AWS SSM Parameter Store parameters, SecureString parameters are decrypted.
+// Parameters under the path are read by GetParametersByPath, otherwise they are read by GetParameters batches
+type SSMReader struct {
+	client ssmiface.SSMAPI
+	path   string
+	tag    string
+	// Logger of the reader, LibLogger is used if it is not set
+	Logger Logger
+}
+
+// reads SSM parameters to the provided configuration structure
+func (r SSMReader) Read(metas []StructMeta) error {
+	return r.ReadContext(context.Background(), metas)
+}
+
+// ReadContext reads SSM parameters, cancellation of the context interrupts requests
+func (r SSMReader) ReadContext(ctx context.Context, metas []StructMeta) error {
+	logger := loggerOrDefault(r.Logger)
+	names := make(map[int]string)
+	for k, meta := range metas {
+		tag, _ := meta.Tag.Lookup(r.tag)
+		// parameters of the list items are not supported
+		if tag == "" || meta.inList() || !meta.Accepts(r.tag) {
+			continue
+		}
+		names[k] = r.name(tag)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	var (
+		values map[string]string
+		err    error
+	)
+	if r.path != "" {
+		values, err = r.byPath(ctx)
+	} else {
+		values, err = r.byNames(ctx, names)
+	}
+	if err != nil {
+		return err
+	}
+
+	var result *multierror.Error
+	for k, name := range names {
+		meta := metas[k]
+		value, ok := values[name]
+		if !ok {
+			logger.Debug("parameter is not set", "key", name)
+			continue
+		}
+		if err = metas[k].Assign(r.tag, value); err != nil {
+			result = multierror.Append(result, newFieldError(meta, r.tag, name, value, ErrorParse, err))
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+func (r SSMReader) Stop() {
+	// do nothing
+}
+
+func (r SSMReader) provider() string {
+	return r.tag
+}
+
+// name returns the full parameter name of the tag
+func (r SSMReader) name(tag string) string {
+	if r.path == "" {
+		return tag
+	}
+	return strings.TrimSuffix(r.path, "/") + "/" + strings.TrimPrefix(tag, "/")
+}
+
+// byPath reads all the parameters under the path
+func (r SSMReader) byPath(ctx context.Context) (map[string]string, error) {
+	loggerOrDefault(r.Logger).Debug("reading parameters", "path", r.path)
+	values := make(map[string]string)
+	input := &ssm.GetParametersByPathInput{
+		Path:           aws.String(r.path),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(true),
+	}
+	err := r.client.GetParametersByPathPagesWithContext(ctx, input, func(page *ssm.GetParametersByPathOutput, _ bool) bool {
+		for _, p := range page.Parameters {
+			values[aws.StringValue(p.Name)] = aws.StringValue(p.Value)
+		}
+		return true
+	})
+	return values, err
+}
+
+// byNames reads the parameters by batches of the names
+func (r SSMReader) byNames(ctx context.Context, names map[int]string) (map[string]string, error) {
+	unique := make([]string, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+
+	values := make(map[string]string)
+	for start := 0; start < len(unique); start += ssmMaxNames {
+		end := start + ssmMaxNames
+		if end > len(unique) {
+			end = len(unique)
+		}
+		loggerOrDefault(r.Logger).Debug("reading parameters", "names", strings.Join(unique[start:end], ","))
+		out, err := r.client.GetParametersWithContext(ctx, &ssm.GetParametersInput{
+			Names:          aws.StringSlice(unique[start:end]),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range out.Parameters {
+			values[aws.StringValue(p.Name)] = aws.StringValue(p.Value)
+		}
+	}
+	return values, nil
+}
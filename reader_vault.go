@@ -1,7 +1,9 @@
 package config
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/hashicorp/go-multierror"
@@ -14,51 +16,113 @@ type (
 		storage   *StorageVault
 		formatter SecretPathFormatter
 		tag       string
+		// Logger of the reader, LibLogger is used if it is not set
+		Logger Logger
 	}
 )
 
 // reads vault variables to the provided configuration structure
 func (r VaultReader) Read(metas []StructMeta) error {
-	var err error
+	return r.ReadContext(context.Background(), metas)
+}
 
-	keyMap := r.storage.InitMemorisedKvMap()
+// ReadContext reads vault variables, cancellation of the context interrupts vault requests
+func (r VaultReader) ReadContext(ctx context.Context, metas []StructMeta) error {
+	keyMap := r.storage.initMemorisedKvMap(ctx)
 
+	logger := loggerOrDefault(r.Logger)
 	var result *multierror.Error
 	for k, meta := range metas {
-		var val interface{}
+		var (
+			val interface{}
+			err error
+		)
 		tag, _ := meta.Tag.Lookup(r.tag)
-		if tag == "" {
+		if tag == "" || !meta.Accepts(r.tag) {
 			continue
 		}
 		vaultTags := strings.Split(tag, ":")
 		if len(vaultTags) != 2 {
-			result = multierror.Append(result, fmt.Errorf("%s secret is invalid", tag))
+			result = multierror.Append(result, newFieldError(meta, r.tag, tag, "", ErrorParse, fmt.Errorf("%s secret is invalid", tag)))
 			continue
 		}
 		key := vaultTags[0]
 		if r.formatter != nil {
 			key = r.formatter(key)
 		}
+		// secret version could be pinned by path:key@version
+		secretKey, version := parseSecretVersion(vaultTags[1])
 
-		LibLogger(fmt.Sprintf("reading %s:%s", key, vaultTags[1]))
+		logger.Debug("reading secret", "key", key+":"+vaultTags[1])
 
-		if val, err = keyMap(key, vaultTags[1]); err != nil {
-			if !meta.DefValueProvided || Verbose {
-				result = multierror.Append(result, err)
+		if val, err = keyMap(key, secretKey, version); err != nil {
+			// failures other than missing secrets are reported by the reader
+			if category := errorCategory(err, ErrorParse); category != ErrorMissing {
+				result = multierror.Append(result, newFieldError(meta, r.tag, key+":"+vaultTags[1], "", category, err))
+			} else {
+				logger.Debug("secret is not set", "key", key+":"+vaultTags[1], "error", err)
 			}
 			continue
 		}
 
-		if err = parseValue(meta.FieldValue, val.(string), meta.Separator, meta.Layout); err != nil {
-			result = multierror.Append(result, err)
-		} else {
-			metas[k].Provider = r.tag
+		// null values (e.g. security_token of the AWS credentials) are not set
+		if val == nil {
+			logger.Debug("secret is not set", "key", key+":"+vaultTags[1])
+			continue
+		}
+		rawValue, err := documentValueToString(val, meta.Separator, meta.Layout)
+		if err != nil {
+			result = multierror.Append(result, newFieldError(meta, r.tag, key+":"+vaultTags[1], "", ErrorParse, err))
+			continue
+		}
+
+		if err = metas[k].Assign(r.tag, rawValue); err != nil {
+			result = multierror.Append(result, newFieldError(meta, r.tag, key+":"+vaultTags[1], rawValue, ErrorParse, err))
 		}
 	}
 
-	return result
+	return result.ErrorOrNil()
+}
+
+// Watch notifies about expired leases of the dynamic secrets
+func (r VaultReader) Watch() (<-chan struct{}, error) {
+	return r.storage.Watch()
+}
+
+// published revokes leases of the replaced dynamic secrets, the published config doesn't use them anymore
+func (r VaultReader) published() {
+	r.storage.revokeRetired()
+}
+
+// leased reports whether there are dynamic secrets with expiring leases
+func (r VaultReader) leased() bool {
+	return r.storage.leased()
 }
 
 func (r VaultReader) Stop() {
 	r.storage.Stop()
 }
+
+func (r VaultReader) provider() string {
+	return r.tag
+}
+
+// parseSecretVersion splits "key@version" secret key, 0 version means the latest one.
+// The suffix is a version only if it is a positive number, otherwise @ is a part of the key
+func parseSecretVersion(key string) (string, int) {
+	idx := strings.LastIndex(key, "@")
+	if idx < 0 {
+		return key, 0
+	}
+	suffix := key[idx+1:]
+	for _, c := range suffix {
+		if c < '0' || c > '9' {
+			return key, 0
+		}
+	}
+	version, err := strconv.Atoi(suffix)
+	if err != nil || version <= 0 {
+		return key, 0
+	}
+	return key[:idx], version
+}
@@ -1,17 +1,35 @@
 package config
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"strings"
+	"reflect"
+	"sync"
 	"time"
+)
+
+const (
+	// DefaultDebounce is a default delay between source change notification and config refresh
+	DefaultDebounce = 100 * time.Millisecond
+)
 
-	"github.com/hashicorp/go-multierror"
+const (
+	// LastWins the value of the latter reader overrides the value of the former one
+	LastWins Precedence = iota
+	// FirstWins the value of the first reader which provides the field is kept
+	FirstWins
 )
 
 var (
+	// LibLogger writes messages of the default logger.
+	//
+	// Deprecated: use Service.Logger and the readers Logger field
 	LibLogger = defaultLogger
-	Verbose   = false
+	// Verbose turns on messages of the default logger.
+	//
+	// Deprecated: use Service.Logger and the readers Logger field
+	Verbose = false
 )
 
 type (
@@ -21,130 +39,411 @@ type (
 	}
 	// LoadCallback function to handle config refresh error result
 	LoadCallback func(valid bool, err error)
+	// Precedence defines which reader value is kept if several readers provide the field
+	Precedence int
 	// Service config options
 	Service struct {
-		quit chan bool
+		mu sync.Mutex
+		// refresh loop cancellation
+		cancel context.CancelFunc
+		// background goroutines
+		wg sync.WaitGroup
 		// refresh interval
 		interval time.Duration
+		// delay between change notification and refresh, notifications during the delay are merged
+		Debounce time.Duration
+		// Watch turns on refresh by change notifications of the readers which implement Watcher,
+		// readers are not watched by default, so 0 interval means no background refresh.
+		// Expiration of the vault dynamic secret leases triggers refresh regardless
+		Watch bool
 		// state flag
 		started bool
+		// readers of the service without refresh loop, they are stopped by Stop
+		idle []Reader
+		// last known good config, it is allocated by Store() once
+		store     *Store
+		storeOnce sync.Once
+		// change subscribers
+		subscribers subscribers
 		// config validator
 		Validator Validator
+		// Strict makes the fields without default value required if they have a tag of the library readers,
+		// untagged fields (e.g. set by Updater) and fields of the custom readers are required by data-required only
+		Strict bool
+		// Precedence of the readers, the latter reader wins by default
+		Precedence Precedence
+		// Logger of the service events, LibLogger is used if it is not set
+		Logger Logger
 	}
 )
 
-// Start start config service
+// Start start config service.
+// The cfg is populated once by the initial read, the refreshed config is published by Store only,
+// so Store().Load() is the way to read the config after Start
 func (s *Service) Start(cfg interface{}, cb LoadCallback, readers ...Reader) (bool, error) {
-	valid, err := s.ReadAndValidate(cfg, readers...)
+	return s.StartContext(context.Background(), cfg, cb, readers...)
+}
+
+// StartContext start config service, the context is propagated into readers,
+// its cancellation stops the refresh loop
+func (s *Service) StartContext(ctx context.Context, cfg interface{}, cb LoadCallback, readers ...Reader) (bool, error) {
+	valid, err := s.ReadAndValidateContext(ctx, cfg, readers...)
 	// since it is possible to use more than one reader, then there may be a case that
 	// having read errors we will receive a valid configuration
 	// so run refresh look if acquired config is valid
 	if valid {
-		s.loop(cfg, cb, readers...)
+		s.loop(ctx, s.Store().Load(), cb, readers...)
 	}
 
 	return valid, err
 }
 
-// ReadAndValidate config
+// ReadAndValidate config.
+// Config is populated into a fresh copy, which is published only if it is valid,
+// so the provided cfg and the Store keep the last known good config otherwise
 func (s *Service) ReadAndValidate(cfg interface{}, readers ...Reader) (bool, error) {
+	return s.ReadAndValidateContext(context.Background(), cfg, readers...)
+}
+
+// ReadAndValidateContext config, the context is propagated into readers.
+// Config is not published if the context has been cancelled during reading
+func (s *Service) ReadAndValidateContext(ctx context.Context, cfg interface{}, readers ...Reader) (bool, error) {
+	next, valid, err := s.read(ctx, cfg, readers...)
+	if valid {
+		// the caller's copy doesn't share maps, slices and pointers with the published snapshot
+		reflect.ValueOf(cfg).Elem().Set(cloneValue(reflect.ValueOf(next)).Elem())
+	}
+	return valid, err
+}
+
+// read populates a copy of cfg and publishes it if it is valid, cfg itself is not modified
+func (s *Service) read(ctx context.Context, cfg interface{}, readers ...Reader) (interface{}, bool, error) {
 	var err error
-	var errors *multierror.Error
 	var metaInfo []StructMeta
+	cfgErr := &ConfigError{}
 
 	if len(readers) == 0 {
-		return false, fmt.Errorf("no config readers found")
-	} else {
-		if updater, ok := cfg.(Updater); ok {
-			if err = updater.Update(); err != nil {
-				return false, err
-			}
-		}
+		return nil, false, fmt.Errorf("no config readers found")
+	}
 
-		metaInfo, err = ReadStructMetadata(cfg)
-		if err != nil {
-			return false, err
+	cfgValue := reflect.ValueOf(cfg)
+	if cfgValue.Kind() != reflect.Ptr || cfgValue.Elem().Kind() != reflect.Struct {
+		return nil, false, fmt.Errorf("pointer to structure expected, got %T", cfg)
+	}
+	next := cloneValue(cfgValue)
+	nextCfg := next.Interface()
+
+	if updater, ok := nextCfg.(Updater); ok {
+		if err = updater.Update(); err != nil {
+			return nil, false, err
 		}
+	}
+
+	readers = s.prepare(ctx, cfgErr, readers)
+	if ctx.Err() != nil {
+		return nil, false, ctx.Err()
+	}
 
-		if err = setDefaults(metaInfo); err != nil {
-			errors = multierror.Append(errors, err)
+	metaInfo, err = s.readMetadata(nextCfg, readers...)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if s.Precedence == FirstWins {
+		for k := range metaInfo {
+			metaInfo[k].firstWins = true
 		}
+	}
 
-		for _, reader := range readers {
-			if err = reader.Read(metaInfo); err != nil {
-				errors = multierror.Append(errors, err)
-			}
+	if err = setDefaults(metaInfo); err != nil {
+		cfgErr.add("default", err)
+	}
+
+	logger := s.logger()
+	for _, reader := range readers {
+		readerName := fmt.Sprintf("%T", reader)
+		logger.Debug("reader started", "reader", readerName)
+		started := time.Now()
+		if err = readContext(ctx, reader, metaInfo); err != nil {
+			cfgErr.add(readerProvider(reader), err)
+		}
+		logger.Debug("reader finished", "reader", readerName, "duration", time.Since(started), "error", err)
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
 		}
 	}
 
-	dumpMetas(metaInfo)
+	dumpMetas(logger, metaInfo)
 
 	valid := true
+	if missing := s.missingFields(metaInfo); len(missing) > 0 {
+		cfgErr.Errors = append(cfgErr.Errors, missing...)
+		valid = false
+	}
 	if s.Validator != nil {
-		if err = s.Validator.Validate(cfg); err != nil {
-			errors = multierror.Append(errors, err)
+		if err = s.Validator.Validate(nextCfg); err != nil {
+			cfgErr.addValidation(err, metaInfo)
 			valid = false
 		}
 	}
 
-	if errors != nil {
-		errors.ErrorFormat = errorFormatter
-		err = errors.ErrorOrNil()
+	if valid {
+		prevCfg := s.Store().Load()
+		s.Store().publish(nextCfg)
+		for _, reader := range readers {
+			if l, ok := reader.(publishListener); ok {
+				l.published()
+			}
+		}
+		s.notifyChanges(prevCfg, nextCfg, metaInfo)
 	}
 
-	return valid, err
+	return nextCfg, valid, cfgErr.errorOrNil()
+}
+
+// prepare calls Prepare of the readers which implement Preparer, failed readers are excluded from the refresh
+func (s *Service) prepare(ctx context.Context, cfgErr *ConfigError, readers []Reader) []Reader {
+	prepared := make([]Reader, 0, len(readers))
+	for _, reader := range readers {
+		if p, ok := reader.(Preparer); ok {
+			if err := p.Prepare(ctx); err != nil {
+				s.logger().Debug("reader prepare failed", "reader", fmt.Sprintf("%T", reader), "error", err)
+				cfgErr.add(readerProvider(reader), err)
+				continue
+			}
+		}
+		prepared = append(prepared, reader)
+	}
+	return prepared
 }
 
-// loop run config refresh
-func (s *Service) loop(cfg interface{}, cb LoadCallback, readers ...Reader) {
-	// start loop if time duration > 0 and not started yet
-	if !s.started && s.interval > 0 {
-		nextRead := time.After(s.interval)
+// missingFields reports required fields which have not been set by any reader or default,
+// ConfigError summarises them by a single message
+func (s *Service) missingFields(metas []StructMeta) []*FieldError {
+	var missing []*FieldError
+	for _, meta := range metas {
+		if (meta.Required || (s.Strict && !meta.DefValueProvided && hasReaderTag(meta))) && meta.Provider == "-" {
+			missing = append(missing, newFieldError(meta, "", "", "", ErrorMissing, errRequiredField))
+		}
+	}
+	return missing
+}
+
+// readMetadata reads structure metadata, lists of structures are resized to the number of items
+// provided by the readers, so the metadata contains fields of every item
+func (s *Service) readMetadata(cfg interface{}, readers ...Reader) ([]StructMeta, error) {
+	sized := make(map[string]bool)
+	for {
+		metas, lists, err := readStructMetadata(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		resized := false
+		for _, list := range lists {
+			// items of the resized list could contain lists as well, so metadata is re-read until nothing is changed
+			if sized[list.Path] {
+				continue
+			}
+			sized[list.Path] = true
+
+			size := -1
+			for _, reader := range readers {
+				if sizer, ok := reader.(ListSizer); ok {
+					if n := sizer.ListSize(list); n > size {
+						size = n
+					}
+				}
+			}
+			if size < 0 || size == list.FieldValue.Len() {
+				continue
+			}
+			if size > 0 {
+				allocate(list.allocs)
+			}
+			resizeList(list.FieldValue, size)
+			resized = true
+		}
+
+		if !resized {
+			return metas, nil
+		}
+	}
+}
+
+// Subscribe to the changes of all the fields, callback is called after every refresh which changes the config
+func (s *Service) Subscribe(cb ChangeCallback) {
+	s.subscribers.add("", cb)
+}
+
+// SubscribeField subscribes to the changes of the specific field only
+func (s *Service) SubscribeField(field string, cb ChangeCallback) {
+	s.subscribers.add(field, cb)
+}
+
+// notifyChanges compares previous config with the new one and notifies subscribers
+func (s *Service) notifyChanges(prevCfg, nextCfg interface{}, metas []StructMeta) {
+	if prevCfg == nil || reflect.TypeOf(prevCfg) != reflect.TypeOf(nextCfg) {
+		return
+	}
+	prevMetas, err := ReadStructMetadata(prevCfg)
+	if err != nil {
+		return
+	}
+	s.subscribers.notify(diffMetas(prevMetas, metas))
+}
+
+// Store gives access to the last known good config, it should be used to read config concurrently with refresh
+func (s *Service) Store() *Store {
+	s.storeOnce.Do(func() {
+		s.store = &Store{}
+	})
+	return s.store
+}
+
+// loop run config refresh, every refresh populates a copy of the last published config,
+// so the caller's config is never written by the loop goroutine
+func (s *Service) loop(parent context.Context, cfg interface{}, cb LoadCallback, readers ...Reader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	changes, watching := s.watch(ctx, readers...)
+
+	// start loop if time duration > 0 or some of readers are watched
+	if s.interval <= 0 && !watching {
+		cancel()
+		// readers could run background work started by the initial read (e.g. vault token or lease renewal)
+		s.idle = readers
+		return
+	}
+
+	var nextRead, debounce <-chan time.Time
+	if s.interval > 0 {
+		nextRead = time.After(s.interval)
+	}
+	refresh := func() {
+		next, valid, err := s.read(ctx, cfg, readers...)
+		if valid {
+			cfg = next
+		}
+		// service has been stopped during refresh
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.logger().Error("refresh failed", "valid", valid, "error", err)
+		}
+		if cb != nil {
+			cb(valid, err)
+		}
+	}
+
+	s.cancel = cancel
+	s.started = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				for _, r := range readers {
+					r.Stop()
+				}
+				s.mu.Lock()
+				s.started = false
+				s.mu.Unlock()
+				return
+			case <-changes:
+				debounce = time.After(s.Debounce)
+			case <-debounce:
+				debounce = nil
+				refresh()
+			case <-nextRead:
+				refresh()
+				nextRead = time.After(s.interval)
+			}
+		}
+	}()
+}
+
+// watch merges change notifications of the readers which implement Watcher if Service.Watch is turned on.
+// Lease expiration is watched regardless, if the readers have leases or the secrets are read by interval
+func (s *Service) watch(ctx context.Context, readers ...Reader) (<-chan struct{}, bool) {
+	changes := make(chan struct{}, 1)
+	watching := false
+
+	for _, r := range readers {
+		w, ok := r.(Watcher)
+		if !ok {
+			continue
+		}
+		if lw, ok := r.(leaseWatcher); !s.Watch && !(ok && (s.interval > 0 || lw.leased())) {
+			continue
+		}
+		notify, err := w.Watch()
+		if err != nil {
+			// reader will be refreshed by interval
+			s.logger().Warn("failed to watch changes", "reader", fmt.Sprintf("%T", r), "error", err)
+			continue
+		}
+		watching = true
+		s.wg.Add(1)
 		go func() {
+			defer s.wg.Done()
 			for {
 				select {
-				case <-s.quit:
-					s.started = false
-					for _, r := range readers {
-						r.Stop()
-					}
+				case <-ctx.Done():
 					return
-				case <-nextRead:
-					valid, err := s.ReadAndValidate(cfg, readers...)
-					if cb != nil {
-						cb(valid, err)
+				case _, ok := <-notify:
+					if !ok {
+						// closed channel means the reader stopped watching
+						return
+					}
+					select {
+					case changes <- struct{}{}:
+					default:
 					}
-					nextRead = time.After(s.interval)
 				}
 			}
 		}()
-		s.started = true
 	}
+
+	return changes, watching
 }
 
-// Stop config service
+// Stop config service, in-flight refresh is cancelled and Stop waits until the background goroutines are finished.
+// Readers are stopped even if the refresh loop has not been started. It is safe to call Stop more than once
 func (s *Service) Stop() error {
-	if s.started && s.quit != nil {
-		s.quit <- true
-		close(s.quit)
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	idle := s.idle
+	s.idle = nil
+	s.mu.Unlock()
+	s.wg.Wait()
+
+	// the refresh loop stops its readers itself
+	for _, r := range idle {
+		r.Stop()
 	}
 
 	return nil
 }
 
+// logger returns the service logger or the default one
+func (s *Service) logger() Logger {
+	return loggerOrDefault(s.Logger)
+}
+
 func defaultLogger(i ...interface{}) {
 	if Verbose {
 		log.Println(i...)
 	}
 }
-
-func errorFormatter(es []error) string {
-	points := make([]string, len(es))
-	for i, err := range es {
-		points[i] = err.Error()
-	}
-
-	return fmt.Sprintf(
-		"%d errors occurred: %s",
-		len(es), strings.Join(points, ", "))
-}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"sync"
+)
+
+// sourceSnapshot keeps the source loaded by Prepare of the reader, ListSize and the following Read use it,
+// so they see the same version of the source. Methods of the nil snapshot do nothing
+type sourceSnapshot struct {
+	mu    sync.Mutex
+	value interface{}
+}
+
+func (s *sourceSnapshot) set(value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.value = value
+	s.mu.Unlock()
+}
+
+func (s *sourceSnapshot) current() interface{} {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.value
+}
+
+// take returns the snapshot once, so the next Read without Prepare loads the source again
+func (s *sourceSnapshot) take() interface{} {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value := s.value
+	s.value = nil
+	return value
+}
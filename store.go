@@ -0,0 +1,107 @@
+package config
+
+import (
+	"reflect"
+	"sync/atomic"
+)
+
+// Store keeps the last known good configuration snapshot, it is safe for concurrent use.
+// Snapshot is replaced as a whole on every successful refresh, so it must not be modified by the caller
+type Store struct {
+	value atomic.Value
+}
+
+// snapshot is a wrapper which allows to keep different config types in the same atomic.Value
+type snapshot struct {
+	cfg interface{}
+}
+
+// Load returns the pointer to the last published configuration or nil if nothing has been published yet
+func (st *Store) Load() interface{} {
+	if s, ok := st.value.Load().(snapshot); ok {
+		return s.cfg
+	}
+	return nil
+}
+
+// publish replaces the current snapshot
+func (st *Store) publish(cfg interface{}) {
+	st.value.Store(snapshot{cfg: cfg})
+}
+
+// cloneKey identifies a pointer, slice or map which has been cloned already
+type cloneKey struct {
+	typ reflect.Type
+	ptr uintptr
+	len int
+}
+
+// cloneValue makes a copy of the value, pointers, slices and maps are copied recursively,
+// so populating the copy doesn't affect the original value
+func cloneValue(v reflect.Value) reflect.Value {
+	return cloneVisited(v, make(map[cloneKey]reflect.Value))
+}
+
+// cloneVisited copies the value, the values which have been copied already are reused,
+// so cyclic references are copied as cycles instead of infinite recursion
+func cloneVisited(v reflect.Value, visited map[cloneKey]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		key := cloneKey{typ: v.Type(), ptr: v.Pointer()}
+		if c, ok := visited[key]; ok {
+			return c
+		}
+		c := reflect.New(v.Type().Elem())
+		visited[key] = c
+		c.Elem().Set(cloneVisited(v.Elem(), visited))
+		return c
+
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			// unexported fields are copied as is
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(cloneVisited(v.Field(i), visited))
+			}
+		}
+		return c
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		key := cloneKey{typ: v.Type(), ptr: v.Pointer(), len: v.Len()}
+		if c, ok := visited[key]; ok {
+			return c
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		visited[key] = c
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(cloneVisited(v.Index(i), visited))
+		}
+		return c
+
+	case reflect.Map:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		key := cloneKey{typ: v.Type(), ptr: v.Pointer()}
+		if c, ok := visited[key]; ok {
+			return c
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		visited[key] = c
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), cloneVisited(iter.Value(), visited))
+		}
+		return c
+
+	default:
+		return v
+	}
+}
@@ -1,8 +1,14 @@
 package config
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
 
 	"github.com/hashicorp/vault/api"
 )
@@ -10,6 +16,7 @@ import (
 var (
 	errEnvVaultEmptyAddress = errors.New("empty address for vault api")
 	errAuthMount            = errors.New("empty auth mount")
+	errEmptyClientToken     = errors.New("empty auth.client_token property in login response")
 )
 
 type (
@@ -21,39 +28,77 @@ type (
 		Stop()
 	}
 
+	// VaultContextAuthenticate could be implemented by VaultAuthenticate to support cancellation of the login requests
+	VaultContextAuthenticate interface {
+		AuthenticateContext(ctx context.Context) error
+	}
+
 	StorageVault struct {
 		VaultAuthenticate
 		vaultDataKey string
+
+		mu sync.Mutex
+		// detected secret engine mounts
+		mounts []kvMount
+		// secret paths which mount could not be detected
+		undetected map[string]bool
+		// metadata of the last read KV v2 secret versions
+		metadata map[secretVersion]SecretMetadata
+		// leases of the dynamic secrets
+		leases      map[string]*vaultLease
+		leaseNotify chan struct{}
+		wg          sync.WaitGroup
+		// leases of the replaced secrets, they are revoked once the config with the new secrets is published
+		retired []*vaultLease
+		// Logger of the secrets and leases events, LibLogger is used if it is not set
+		Logger Logger
 	}
 )
 
 func (st *StorageVault) Read(vaultPath string) (map[string]interface{}, error) {
-	if err := st.Authenticate(); err != nil {
+	return st.ReadContext(context.Background(), vaultPath)
+}
+
+func (st *StorageVault) ReadContext(ctx context.Context, vaultPath string) (map[string]interface{}, error) {
+	// dynamic secret is reused while its lease is active
+	if data, ok := st.leasedData(vaultPath); ok {
+		return data, nil
+	}
+
+	if err := st.authenticate(ctx); err != nil {
 		return nil, err
 	}
 
-	vaultSecret, err := st.GetClient().Logical().Read(vaultPath)
+	vaultSecret, err := vaultRequest(ctx, st.GetClient(), http.MethodGet, vaultPath, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	if vaultSecret == nil {
-		return nil, fmt.Errorf("nil secret on %s", vaultPath)
+		return nil, withCategory(ErrorMissing, fmt.Errorf("nil secret on %s", vaultPath))
 	}
 
 	if vaultSecret.Data == nil {
-		return nil, fmt.Errorf("nil secret.Data on %s", vaultPath)
+		return nil, withCategory(ErrorMissing, fmt.Errorf("nil secret.Data on %s", vaultPath))
+	}
+
+	if vaultSecret.LeaseID != "" {
+		st.trackLease(vaultPath, vaultSecret)
 	}
 
 	return vaultSecret.Data, nil
 }
 
 func (st *StorageVault) Write(vaultPath string, data map[string]interface{}) (map[string]interface{}, error) {
-	if err := st.Authenticate(); err != nil {
+	return st.WriteContext(context.Background(), vaultPath, data)
+}
+
+func (st *StorageVault) WriteContext(ctx context.Context, vaultPath string, data map[string]interface{}) (map[string]interface{}, error) {
+	if err := st.authenticate(ctx); err != nil {
 		return nil, err
 	}
 
-	vaultSecret, err := st.GetClient().Logical().Write(vaultPath, data)
+	vaultSecret, err := vaultRequest(ctx, st.GetClient(), http.MethodPut, vaultPath, data)
 	if err != nil {
 		return nil, err
 	}
@@ -69,34 +114,126 @@ func (st *StorageVault) Write(vaultPath string, data map[string]interface{}) (ma
 	return vaultSecret.Data, nil
 }
 
+// authenticate by context aware authenticator if it is supported
+func (st *StorageVault) authenticate(ctx context.Context) error {
+	if auth, ok := st.VaultAuthenticate.(VaultContextAuthenticate); ok {
+		return withCategory(ErrorAuth, auth.AuthenticateContext(ctx))
+	}
+	return withCategory(ErrorAuth, st.Authenticate())
+}
+
 // InitMemorisedKvMap avoid too many allocations by memorizing the "path|key" pair for an event
 // @see https://gobyexample.com/closures
 func (st *StorageVault) InitMemorisedKvMap() func(path string, key string) (interface{}, error) {
-	m := make(map[string]map[string]interface{})
+	kvMap := st.initMemorisedKvMap(context.Background())
 	return func(path string, key string) (interface{}, error) {
-		if _, ok := m[path]; !ok {
-			if data, err := st.Read(path); err != nil {
+		return kvMap(path, key, 0)
+	}
+}
+
+// initMemorisedKvMap memorizes secrets by the path and version, 0 version means the latest one
+func (st *StorageVault) initMemorisedKvMap(ctx context.Context) func(path string, key string, version int) (interface{}, error) {
+	m := make(map[string]map[string]interface{})
+	return func(path string, key string, version int) (interface{}, error) {
+		memoKey := path
+		if version > 0 {
+			memoKey = fmt.Sprintf("%s@%d", path, version)
+		}
+		if _, ok := m[memoKey]; !ok {
+			secretData, err := st.readKV(ctx, path, version)
+			if err != nil {
 				return nil, err
-			} else {
-				// retrieve data
-				var secret interface{}
-				if secret, ok = data[st.vaultDataKey]; !ok {
-					return nil, fmt.Errorf("failed to get data on %s for %s", path, st.vaultDataKey)
-				}
-				// cast data
-				var secretData map[string]interface{}
-				if secretData, ok = secret.(map[string]interface{}); !ok {
-					return nil, fmt.Errorf("failed to cast to key-value pairs on %s", path)
-				}
-				// store data
-				m[path] = secretData
 			}
+			// store data
+			m[memoKey] = secretData
 		}
 		// search in memorized data
-		if k, ok := m[path][key]; !ok {
-			return nil, fmt.Errorf("nil value on %s:%s", path, key)
+		if k, ok := m[memoKey][key]; !ok {
+			return nil, withCategory(ErrorMissing, fmt.Errorf("nil value on %s:%s", memoKey, key))
 		} else {
 			return k, nil
 		}
 	}
 }
+
+// vaultRequest sends logical request with context, since api.Logical doesn't support it.
+// Response handling follows api.Logical: nil secret is returned for not found path without data
+func vaultRequest(ctx context.Context, client *api.Client, method, path string, data map[string]interface{}) (*api.Secret, error) {
+	r := client.NewRequest(method, "/v1/"+path)
+	if data != nil {
+		if err := r.SetJSONBody(data); err != nil {
+			return nil, err
+		}
+	}
+
+	return vaultDo(ctx, client, r)
+}
+
+// vaultLogin sends login request to the auth mount and returns the secret with the client token.
+// Current client token is not sent, since it may be expired already
+func vaultLogin(ctx context.Context, client *api.Client, mount string, data map[string]interface{}) (*api.Secret, error) {
+	if mount == "" {
+		return nil, errAuthMount
+	}
+
+	r := client.NewRequest(http.MethodPut, path.Join("/v1/auth", strings.Trim(mount, "/"), "login"))
+	r.ClientToken = ""
+	if err := r.SetJSONBody(data); err != nil {
+		return nil, err
+	}
+
+	secret, err := vaultDo(ctx, client, r)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, errEmptyClientToken
+	}
+
+	return secret, nil
+}
+
+// vaultUnwrap unwraps response-wrapped secret by the wrapping token
+func vaultUnwrap(ctx context.Context, client *api.Client, wrappingToken string) (*api.Secret, error) {
+	r := client.NewRequest(http.MethodPut, "/v1/sys/wrapping/unwrap")
+	r.ClientToken = wrappingToken
+
+	secret, err := vaultDo(ctx, client, r)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("nil secret on unwrap")
+	}
+
+	return secret, nil
+}
+
+// vaultDo sends the request and parses the secret from response
+func vaultDo(ctx context.Context, client *api.Client, r *api.Request) (*api.Secret, error) {
+	resp, err := client.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+	}
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		secret, parseErr := api.ParseSecret(resp.Body)
+		switch parseErr {
+		case nil:
+		case io.EOF:
+			return nil, nil
+		default:
+			return nil, withCategory(ErrorMissing, err)
+		}
+		if secret != nil && (len(secret.Warnings) > 0 || len(secret.Data) > 0) {
+			return secret, nil
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return api.ParseSecret(resp.Body)
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/vault/api"
+)
+
+var (
+	errAppRoleEmptyRoleID   = errors.New("empty AppRole role_id")
+	errAppRoleEmptySecretID = errors.New("empty AppRole secret_id")
+)
+
+type (
+	// VaultSecretIDSource provides secret_id for the AppRole login
+	VaultSecretIDSource func(ctx context.Context, client *api.Client) (string, error)
+
+	VaultAppRoleAuth struct {
+		VaultTokenAuth
+
+		vaultAuthMount string
+		roleID         string
+		secretID       VaultSecretIDSource
+	}
+)
+
+// AppRoleSecretID uses secret_id as is
+func AppRoleSecretID(secretID string) VaultSecretIDSource {
+	return func(context.Context, *api.Client) (string, error) {
+		return secretID, nil
+	}
+}
+
+// AppRoleSecretIDFromFile reads secret_id from the file on every login, so the file could be rotated
+func AppRoleSecretIDFromFile(path string) VaultSecretIDSource {
+	return func(context.Context, *api.Client) (string, error) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+}
+
+// AppRoleSecretIDFromWrappedToken unwraps secret_id by the response-wrapping token.
+// Wrapping token is single-use, so unwrapped secret_id is kept for the next logins
+func AppRoleSecretIDFromWrappedToken(wrappingToken string) VaultSecretIDSource {
+	var (
+		mu       sync.Mutex
+		secretID string
+	)
+	return func(ctx context.Context, client *api.Client) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if secretID != "" {
+			return secretID, nil
+		}
+		secret, err := vaultUnwrap(ctx, client, wrappingToken)
+		if err != nil {
+			return "", err
+		}
+		id, ok := secret.Data["secret_id"].(string)
+		if !ok || id == "" {
+			return "", errAppRoleEmptySecretID
+		}
+		secretID = id
+		return secretID, nil
+	}
+}
+
+func (a *VaultAppRoleAuth) Authenticate() error {
+	return a.AuthenticateContext(context.Background())
+}
+
+func (a *VaultAppRoleAuth) AuthenticateContext(ctx context.Context) error {
+	if a.loginRequired() {
+		if a.roleID == "" {
+			return errAppRoleEmptyRoleID
+		}
+		secretID, err := a.secretID(ctx, a.Client)
+		if err != nil {
+			return err
+		}
+		if secretID == "" {
+			return errAppRoleEmptySecretID
+		}
+		return a.login(ctx, a.vaultAuthMount, map[string]interface{}{
+			"role_id":   a.roleID,
+			"secret_id": secretID,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"context"
+)
+
+type VaultCertAuth struct {
+	VaultTokenAuth
+
+	vaultAuthMount string
+	role           string
+}
+
+func (a *VaultCertAuth) Authenticate() error {
+	return a.AuthenticateContext(context.Background())
+}
+
+// AuthenticateContext logs in by the client certificate configured in the api.Config,
+// empty role means that vault will try to match the certificate against all the roles
+func (a *VaultCertAuth) AuthenticateContext(ctx context.Context) error {
+	if a.loginRequired() {
+		data := make(map[string]interface{})
+		if a.role != "" {
+			data["name"] = a.role
+		}
+		return a.login(ctx, a.vaultAuthMount, data)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"io/ioutil"
@@ -42,7 +43,7 @@ func (a *VaultIAMAuth) getAuthUrl() (string, error) {
 		path.Join("/v1/auth", strings.Trim(a.vaultAuthMount, "/"), "login"), nil
 }
 
-func (a *VaultIAMAuth) sendAuthRequest() (*api.Secret, error) {
+func (a *VaultIAMAuth) sendAuthRequest(ctx context.Context) (*api.Secret, error) {
 	URL, err := a.getAuthUrl()
 	if err != nil {
 		return nil, err
@@ -54,6 +55,7 @@ func (a *VaultIAMAuth) sendAuthRequest() (*api.Secret, error) {
 	}
 	stsSvc := sts.New(sess)
 	req, _ := stsSvc.GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+	req.SetContext(ctx)
 
 	if a.vaultAuthHeader != "" {
 		// if supplied, and then sign the request including that header
@@ -80,7 +82,7 @@ func (a *VaultIAMAuth) sendAuthRequest() (*api.Secret, error) {
 	d["iam_request_body"] = base64.StdEncoding.EncodeToString(body)
 	d["role"] = a.vaultAuthRole
 
-	resp, err := a.Client.Logical().Write(URL, d)
+	resp, err := vaultRequest(ctx, a.Client, http.MethodPut, URL, d)
 	if err != nil {
 		return nil, err
 	}
@@ -91,22 +93,20 @@ func (a *VaultIAMAuth) sendAuthRequest() (*api.Secret, error) {
 		a.GetClient().SetToken(token)
 	}
 
-	return a.getTokenEntity()
+	return a.getTokenEntity(ctx)
 }
 
 func (a *VaultIAMAuth) Authenticate() error {
-	if a.Secret == nil || a.isExpired() {
-		auth, err := a.sendAuthRequest()
+	return a.AuthenticateContext(context.Background())
+}
+
+func (a *VaultIAMAuth) AuthenticateContext(ctx context.Context) error {
+	if a.loginRequired() {
+		auth, err := a.sendAuthRequest(ctx)
 		if err != nil {
 			return err
 		}
-		a.Secret = auth
-		if token, err := a.Secret.TokenID(); err != nil {
-			return err
-		} else {
-			a.Client.SetToken(token)
-			return a.renewToken()
-		}
+		return a.setSecret(auth)
 	}
 	return nil
 }
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var errJWTEmpty = errors.New("empty JWT")
+
+type (
+	// VaultJWTSource provides JWT for the login, it is called on every login
+	VaultJWTSource func(ctx context.Context) (string, error)
+
+	VaultJWTAuth struct {
+		VaultTokenAuth
+
+		vaultAuthMount string
+		role           string
+		jwt            VaultJWTSource
+	}
+)
+
+// JWTFromFile reads JWT from the file on every login, so projected service account tokens could be rotated
+func JWTFromFile(path string) VaultJWTSource {
+	return func(context.Context) (string, error) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+}
+
+// JWTFromEnv reads JWT from the environment variable on every login
+func JWTFromEnv(name string) VaultJWTSource {
+	return func(context.Context) (string, error) {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("%s is not set", name)
+		}
+		return strings.TrimSpace(value), nil
+	}
+}
+
+func (a *VaultJWTAuth) Authenticate() error {
+	return a.AuthenticateContext(context.Background())
+}
+
+func (a *VaultJWTAuth) AuthenticateContext(ctx context.Context) error {
+	if a.loginRequired() {
+		jwt, err := a.jwt(ctx)
+		if err != nil {
+			return err
+		}
+		if jwt == "" {
+			return errJWTEmpty
+		}
+		return a.login(ctx, a.vaultAuthMount, map[string]interface{}{
+			"role": a.role,
+			"jwt":  jwt,
+		})
+	}
+	return nil
+}
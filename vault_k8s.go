@@ -2,6 +2,7 @@ package config
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -76,7 +77,7 @@ func (a *VaultK8sAuth) getAuthUrl() (string, error) {
 		path.Join("/v1/auth", strings.Trim(a.vaultAuthMount, "/"), "login"), nil
 }
 
-func (a *VaultK8sAuth) sendAuthRequest() (*http.Response, error) {
+func (a *VaultK8sAuth) sendAuthRequest(ctx context.Context) (*http.Response, error) {
 	err := a.readK8sJwtToken()
 	if err != nil {
 		return nil, err
@@ -93,7 +94,7 @@ func (a *VaultK8sAuth) sendAuthRequest() (*http.Response, error) {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, URL, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, URL, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
@@ -102,7 +103,7 @@ func (a *VaultK8sAuth) sendAuthRequest() (*http.Response, error) {
 
 }
 
-func (a *VaultK8sAuth) parseResponseToken(res *http.Response) (*api.Secret, error) {
+func (a *VaultK8sAuth) parseResponseToken(ctx context.Context, res *http.Response) (*api.Secret, error) {
 	defer func() {
 		_ = res.Body.Close()
 	}()
@@ -129,25 +130,23 @@ func (a *VaultK8sAuth) parseResponseToken(res *http.Response) (*api.Secret, erro
 		a.GetClient().SetToken(result.Auth.ClientToken)
 	}
 
-	return a.getTokenEntity()
+	return a.getTokenEntity(ctx)
 }
 
 func (a *VaultK8sAuth) Authenticate() error {
-	if a.Secret == nil || a.isExpired() {
-		res, err := a.sendAuthRequest()
+	return a.AuthenticateContext(context.Background())
+}
+
+func (a *VaultK8sAuth) AuthenticateContext(ctx context.Context) error {
+	if a.loginRequired() {
+		res, err := a.sendAuthRequest(ctx)
 		if err != nil {
 			return err
 		}
-		if auth, err := a.parseResponseToken(res); err != nil {
+		if auth, err := a.parseResponseToken(ctx, res); err != nil {
 			return err
 		} else {
-			a.Secret = auth
-			if token, err := a.Secret.TokenID(); err != nil {
-				return err
-			} else {
-				a.Client.SetToken(token)
-				return a.renewToken()
-			}
+			return a.setSecret(auth)
 		}
 	}
 	return nil
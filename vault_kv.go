@@ -0,0 +1,255 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kvVersion1 = 1
+	kvVersion2 = 2
+
+	// kvDataKey is the data key of KV v2 responses, paths of the storage with this key include data segment
+	kvDataKey = "data"
+)
+
+type (
+	// SecretMetadata is a KV v2 secret version metadata
+	SecretMetadata struct {
+		Path         string
+		Version      int
+		CreatedTime  time.Time
+		DeletionTime time.Time
+		Destroyed    bool
+	}
+
+	// kvMount is a secret engine mount
+	kvMount struct {
+		path    string
+		version int
+	}
+
+	// secretVersion identifies metadata of the secret version, 0 version is the latest one
+	secretVersion struct {
+		path    string
+		version int
+	}
+)
+
+// Deleted reports is the secret version soft deleted
+func (md SecretMetadata) Deleted() bool {
+	return !md.DeletionTime.IsZero()
+}
+
+// Metadata returns metadata of the last read latest secret version, it is available for KV v2 secrets only
+func (st *StorageVault) Metadata(secretPath string) (SecretMetadata, bool) {
+	return st.VersionMetadata(secretPath, 0)
+}
+
+// VersionMetadata returns metadata of the pinned secret version which has been read, 0 version is the latest one
+func (st *StorageVault) VersionMetadata(secretPath string, version int) (SecretMetadata, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	md, ok := st.metadata[secretVersion{path: secretPath, version: version}]
+	return md, ok
+}
+
+// ReadMetadata reads metadata of the current secret version
+func (st *StorageVault) ReadMetadata(secretPath string) (SecretMetadata, error) {
+	return st.ReadMetadataContext(context.Background(), secretPath)
+}
+
+// ReadMetadataContext reads metadata of the current secret version, it is available for KV v2 secrets only
+func (st *StorageVault) ReadMetadataContext(ctx context.Context, secretPath string) (SecretMetadata, error) {
+	if err := st.authenticate(ctx); err != nil {
+		return SecretMetadata{}, err
+	}
+
+	mount := st.kvMount(ctx, secretPath)
+	if mount.version != kvVersion2 {
+		return SecretMetadata{}, fmt.Errorf("metadata is supported by KV v2 only, %s is not", secretPath)
+	}
+
+	secret, err := vaultRequest(ctx, st.GetClient(), http.MethodGet, mount.apiPath("metadata", st.logicalPath(mount, secretPath)), nil)
+	if err != nil {
+		return SecretMetadata{}, err
+	}
+	if secret == nil || secret.Data == nil {
+		return SecretMetadata{}, fmt.Errorf("nil metadata on %s", secretPath)
+	}
+
+	version, err := strconv.Atoi(fmt.Sprintf("%v", secret.Data["current_version"]))
+	if err != nil {
+		return SecretMetadata{}, fmt.Errorf("invalid current_version on %s: %w", secretPath, err)
+	}
+	versions, _ := secret.Data["versions"].(map[string]interface{})
+	versionData, _ := versions[strconv.Itoa(version)].(map[string]interface{})
+
+	md := parseSecretMetadata(secretPath, versionData)
+	md.Version = version
+
+	return md, nil
+}
+
+// readKV reads key-value pairs of the secret. KV engine version is detected by the secret mount,
+// so the data path is built for KV v2 automatically and the version could be pinned.
+// Secrets of the other detected engines (e.g. database or AWS dynamic secrets) are read as is,
+// the data key is used only if the mount can not be detected
+func (st *StorageVault) readKV(ctx context.Context, secretPath string, version int) (map[string]interface{}, error) {
+	if st.vaultDataKey != "" && st.vaultDataKey != kvDataKey {
+		return st.readDataKey(ctx, secretPath, version)
+	}
+
+	if err := st.authenticate(ctx); err != nil {
+		return nil, err
+	}
+
+	mount := st.kvMount(ctx, secretPath)
+	if mount.version != kvVersion2 {
+		// undetected mount has no path, the data key of the storage is kept for it
+		if st.vaultDataKey != "" && mount.path == "" {
+			return st.readDataKey(ctx, secretPath, version)
+		}
+		if version > 0 {
+			return nil, fmt.Errorf("version pinning is supported by KV v2 only, %s is not", secretPath)
+		}
+		return st.ReadContext(ctx, secretPath)
+	}
+
+	r := st.GetClient().NewRequest(http.MethodGet, "/v1/"+mount.apiPath("data", st.logicalPath(mount, secretPath)))
+	if version > 0 {
+		r.Params.Set("version", strconv.Itoa(version))
+	}
+	secret, err := vaultDo(ctx, st.GetClient(), r)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, withCategory(ErrorMissing, fmt.Errorf("nil secret on %s", secretPath))
+	}
+
+	metadata, _ := secret.Data["metadata"].(map[string]interface{})
+	md := parseSecretMetadata(secretPath, metadata)
+	if v, err := strconv.Atoi(fmt.Sprintf("%v", metadata["version"])); err == nil {
+		md.Version = v
+	}
+	st.mu.Lock()
+	st.metadata[secretVersion{path: secretPath, version: version}] = md
+	st.mu.Unlock()
+
+	loggerOrDefault(st.Logger).Debug("secret version read", "path", secretPath, "version", md.Version,
+		"created", md.CreatedTime.Format(time.RFC3339))
+
+	// data is nil for deleted or destroyed versions
+	secretData, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("no data on %s version %d (deleted: %t, destroyed: %t)", secretPath, md.Version, md.Deleted(), md.Destroyed)
+	}
+
+	return secretData, nil
+}
+
+// readDataKey reads the secret as is and returns the data of the storage data key
+func (st *StorageVault) readDataKey(ctx context.Context, secretPath string, version int) (map[string]interface{}, error) {
+	if version > 0 {
+		return nil, fmt.Errorf("version pinning is not supported with the data key on %s", secretPath)
+	}
+	data, err := st.ReadContext(ctx, secretPath)
+	if err != nil {
+		return nil, err
+	}
+	// retrieve data
+	secret, ok := data[st.vaultDataKey]
+	if !ok {
+		return nil, fmt.Errorf("failed to get data on %s for %s", secretPath, st.vaultDataKey)
+	}
+	// cast data
+	secretData, ok := secret.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("failed to cast to key-value pairs on %s", secretPath)
+	}
+	return secretData, nil
+}
+
+// logicalPath removes data segment of the path if the storage data key is set, e.g. secret/data/app -> secret/app
+func (st *StorageVault) logicalPath(mount kvMount, secretPath string) string {
+	if st.vaultDataKey == "" {
+		return secretPath
+	}
+	secretPath = strings.Trim(secretPath, "/")
+	if rest := strings.TrimPrefix(secretPath, mount.path+kvDataKey+"/"); rest != secretPath {
+		return mount.path + rest
+	}
+	return secretPath
+}
+
+// kvMount detects the secret engine mount of the secret path,
+// KV v1 is assumed if the mount can not be detected (e.g. no permissions). Failed detection is cached
+// unless the failure is transient, so the detection request is not repeated on every read
+func (st *StorageVault) kvMount(ctx context.Context, secretPath string) kvMount {
+	st.mu.Lock()
+	for _, mount := range st.mounts {
+		if strings.HasPrefix(secretPath, mount.path) {
+			st.mu.Unlock()
+			return mount
+		}
+	}
+	undetected := st.undetected[secretPath]
+	st.mu.Unlock()
+	if undetected {
+		return kvMount{version: kvVersion1}
+	}
+
+	secret, err := vaultRequest(ctx, st.GetClient(), http.MethodGet, "sys/internal/ui/mounts/"+strings.Trim(secretPath, "/"), nil)
+	if err != nil || secret == nil || secret.Data == nil {
+		loggerOrDefault(st.Logger).Warn("failed to detect mount, KV v1 is assumed", "path", secretPath, "error", err)
+		if err == nil || errorCategory(err, ErrorParse) != ErrorTransport {
+			st.mu.Lock()
+			st.undetected[secretPath] = true
+			st.mu.Unlock()
+		}
+		return kvMount{version: kvVersion1}
+	}
+
+	mount := kvMount{version: kvVersion1}
+	mount.path, _ = secret.Data["path"].(string)
+	if options, ok := secret.Data["options"].(map[string]interface{}); ok && secret.Data["type"] == "kv" {
+		if options["version"] == strconv.Itoa(kvVersion2) {
+			mount.version = kvVersion2
+		}
+	}
+
+	if mount.path != "" {
+		st.mu.Lock()
+		st.mounts = append(st.mounts, mount)
+		st.mu.Unlock()
+	}
+
+	return mount
+}
+
+// apiPath builds KV v2 api path, e.g. secret/app -> secret/data/app
+func (m kvMount) apiPath(prefix, secretPath string) string {
+	secretPath = strings.Trim(secretPath, "/")
+	return m.path + prefix + "/" + strings.TrimPrefix(secretPath, strings.Trim(m.path, "/")+"/")
+}
+
+// parseSecretMetadata parses KV v2 version metadata
+func parseSecretMetadata(secretPath string, data map[string]interface{}) SecretMetadata {
+	md := SecretMetadata{Path: secretPath}
+	if data == nil {
+		return md
+	}
+	if s, ok := data["created_time"].(string); ok {
+		md.CreatedTime, _ = time.Parse(time.RFC3339Nano, s)
+	}
+	if s, ok := data["deletion_time"].(string); ok && s != "" {
+		md.DeletionTime, _ = time.Parse(time.RFC3339Nano, s)
+	}
+	md.Destroyed, _ = data["destroyed"].(bool)
+	return md
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// leaseRevokeTimeout limits lease revocation on stop
+const leaseRevokeTimeout = 10 * time.Second
+
+// vaultLease is a lease of the dynamic secret
+type vaultLease struct {
+	path     string
+	secret   *api.Secret
+	expireAt time.Time
+	cancel   context.CancelFunc
+}
+
+// Watch notifies about leases which can not be renewed anymore, so the secrets should be read again
+func (st *StorageVault) Watch() (<-chan struct{}, error) {
+	return st.leaseNotify, nil
+}
+
+// leased reports whether there are leases of the dynamic secrets
+func (st *StorageVault) leased() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.leases) > 0
+}
+
+// Stop renews and revokes leases of the dynamic secrets, then stops authentication
+func (st *StorageVault) Stop() {
+	st.mu.Lock()
+	leases := st.retired
+	st.retired = nil
+	for _, lease := range st.leases {
+		lease.cancel()
+		leases = append(leases, lease)
+	}
+	st.leases = make(map[string]*vaultLease)
+	st.mu.Unlock()
+	st.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), leaseRevokeTimeout)
+	defer cancel()
+	for _, lease := range leases {
+		st.revokeLease(ctx, lease)
+	}
+
+	st.VaultAuthenticate.Stop()
+}
+
+// leasedData returns data of the secret if its lease is still active
+func (st *StorageVault) leasedData(vaultPath string) (map[string]interface{}, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if lease, ok := st.leases[vaultPath]; ok && time.Now().Before(lease.expireAt) {
+		return lease.secret.Data, true
+	}
+	return nil, false
+}
+
+// trackLease keeps the dynamic secret and renews its lease in the background
+func (st *StorageVault) trackLease(vaultPath string, secret *api.Secret) {
+	ctx, cancel := context.WithCancel(context.Background())
+	lease := &vaultLease{
+		path:     vaultPath,
+		secret:   secret,
+		expireAt: time.Now().Add(time.Duration(secret.LeaseDuration) * time.Second),
+		cancel:   cancel,
+	}
+
+	st.mu.Lock()
+	prev, replaced := st.leases[vaultPath]
+	st.leases[vaultPath] = lease
+	// the replaced secret is still used by the last published config until the new one is published
+	// (the refresh could be invalid), so its lease is retired and revoked by revokeRetired
+	if replaced {
+		prev.cancel()
+		if prev.secret.LeaseID != secret.LeaseID {
+			st.retired = append(st.retired, prev)
+		}
+	}
+	st.mu.Unlock()
+
+	st.wg.Add(1)
+	go st.renewLease(ctx, lease)
+}
+
+// revokeRetired revokes leases of the replaced secrets, it is called once the config with the new secrets
+// is published, so the replaced secrets are not used anymore and their leases are not kept until max TTL
+func (st *StorageVault) revokeRetired() {
+	st.mu.Lock()
+	retired := st.retired
+	st.retired = nil
+	st.mu.Unlock()
+
+	for _, lease := range retired {
+		st.wg.Add(1)
+		go func(lease *vaultLease) {
+			defer st.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), leaseRevokeTimeout)
+			defer cancel()
+			st.revokeLease(ctx, lease)
+		}(lease)
+	}
+}
+
+// revokeLease revokes the lease of the secret, failure is logged only as the lease expires by TTL anyway
+func (st *StorageVault) revokeLease(ctx context.Context, lease *vaultLease) {
+	data := map[string]interface{}{"lease_id": lease.secret.LeaseID}
+	if _, err := vaultRequest(ctx, st.GetClient(), http.MethodPut, "sys/leases/revoke", data); err != nil {
+		loggerOrDefault(st.Logger).Error("failed to revoke lease", "path", lease.path, "error", err)
+	}
+}
+
+// renewLease renews renewable lease at 2/3 of its duration. If lease is not renewable
+// or renewal is failed or capped by max TTL, the secret is expired before the lease end
+func (st *StorageVault) renewLease(ctx context.Context, lease *vaultLease) {
+	defer st.wg.Done()
+
+	renewable := lease.secret.Renewable
+	increment := lease.secret.LeaseDuration
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(lease.expireAt) * 2 / 3):
+		}
+
+		if !renewable {
+			st.expireLease(lease, "lease is not renewable")
+			return
+		}
+
+		data := map[string]interface{}{"lease_id": lease.secret.LeaseID, "increment": increment}
+		secret, err := vaultRequest(ctx, st.GetClient(), http.MethodPut, "sys/leases/renew", data)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil || secret == nil || secret.LeaseDuration <= 0 {
+			st.expireLease(lease, fmt.Sprintf("failed to renew lease: %v", err))
+			return
+		}
+
+		st.mu.Lock()
+		lease.expireAt = time.Now().Add(time.Duration(secret.LeaseDuration) * time.Second)
+		st.mu.Unlock()
+		// lease is capped by max TTL, so this is the last renewal
+		renewable = secret.Renewable && secret.LeaseDuration >= increment
+		loggerOrDefault(st.Logger).Info("lease renewed", "path", lease.path, "duration", secret.LeaseDuration)
+	}
+}
+
+// expireLease marks the secret as expired and notifies about it, so the secret will be read again.
+// The lease is kept until the config with the new secret is published, so it is revoked once the new secret is in use
+func (st *StorageVault) expireLease(lease *vaultLease, reason string) {
+	st.mu.Lock()
+	lease.expireAt = time.Now()
+	st.mu.Unlock()
+
+	loggerOrDefault(st.Logger).Warn("lease expired", "path", lease.path, "reason", reason)
+
+	select {
+	case st.leaseNotify <- struct{}{}:
+	default:
+	}
+}
@@ -1,31 +1,36 @@
 package config
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/vault/api"
 )
 
 type VaultTokenAuth struct {
-	quit       chan bool
+	mu         sync.Mutex
+	wg         sync.WaitGroup
+	cancel     context.CancelFunc
 	refreshing bool
 	Client     *api.Client
 	Secret     *api.Secret
+	// Logger of the token renewal, LibLogger is used if it is not set
+	Logger Logger
 }
 
 func (a *VaultTokenAuth) Authenticate() error {
-	if a.Secret == nil || a.isExpired() {
-		if entity, err := a.getTokenEntity(); err != nil {
+	return a.AuthenticateContext(context.Background())
+}
+
+func (a *VaultTokenAuth) AuthenticateContext(ctx context.Context) error {
+	if a.loginRequired() {
+		if entity, err := a.getTokenEntity(ctx); err != nil {
 			return err
 		} else {
-			a.Secret = entity
-			if token, err := a.Secret.TokenID(); err != nil {
-				return err
-			} else {
-				a.Client.SetToken(token)
-				return a.renewToken()
-			}
+			return a.setSecret(entity)
 		}
 	}
 	return nil
@@ -35,87 +40,144 @@ func (a *VaultTokenAuth) GetClient() *api.Client {
 	return a.Client
 }
 
-func (a *VaultTokenAuth) getTokenEntity() (*api.Secret, error) {
-	return a.Client.Auth().Token().LookupSelf()
+func (a *VaultTokenAuth) getTokenEntity(ctx context.Context) (*api.Secret, error) {
+	return vaultRequest(ctx, a.Client, http.MethodGet, "auth/token/lookup-self", nil)
+}
+
+// loginRequired checks is there no token or it has been expired
+func (a *VaultTokenAuth) loginRequired() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.Secret == nil || a.isExpired()
+}
+
+// login authenticates by the auth mount and starts token renewal
+func (a *VaultTokenAuth) login(ctx context.Context, mount string, data map[string]interface{}) error {
+	secret, err := vaultLogin(ctx, a.Client, mount, data)
+	if err != nil {
+		return err
+	}
+	a.Client.SetToken(secret.Auth.ClientToken)
+	entity, err := a.getTokenEntity(ctx)
+	if err != nil {
+		return err
+	}
+	return a.setSecret(entity)
+}
+
+// setSecret assigns token of the secret to the client and (re)starts token renewal
+func (a *VaultTokenAuth) setSecret(secret *api.Secret) error {
+	token, err := secret.TokenID()
+	if err != nil {
+		return err
+	}
+	// stop renewal of the previous token
+	a.Stop()
+	a.mu.Lock()
+	a.Secret = secret
+	a.mu.Unlock()
+	a.Client.SetToken(token)
+	return a.renewToken()
 }
 
 func (a *VaultTokenAuth) isExpired() bool {
 	if a.Secret != nil {
-		renewable, err := a.Secret.TokenIsRenewable()
-		if err != nil {
+		// tokens without expiration (e.g. root) have no expire_time
+		expireTime, ok := a.Secret.Data["expire_time"].(string)
+		if !ok {
 			return false
 		}
-		if renewable {
-			then, err := time.Parse(time.RFC3339Nano, a.Secret.Data["expire_time"].(string))
-			if err != nil {
-				return false
-			}
-			return time.Since(then) > 0
+		then, err := time.Parse(time.RFC3339Nano, expireTime)
+		if err != nil {
+			return false
 		}
+		return time.Since(then) > 0
 	}
 	return false
 }
 
 func (a *VaultTokenAuth) renewToken() error {
-	if a.refreshing {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.refreshing || a.Secret == nil {
 		return nil
 	}
 
-	if a.Secret != nil {
-		ttl, err := a.Secret.TokenTTL()
-		if err != nil {
-			return err
-		}
-		if ttl == 0 {
-			return fmt.Errorf("invalid token TTL")
-		}
-		nextRead := time.After(ttl / 10)
-		go func() {
-			a.refreshing = true
-			for {
-				select {
-				case <-a.quit:
-					a.refreshing = false
-					return
-				case <-nextRead:
-					_, err := a.Client.Auth().Token().RenewSelf(int(ttl.Seconds()))
-					if err != nil {
-						a.onError(err)
-						return
-					}
-					entity, err := a.getTokenEntity()
-					if err != nil {
-						a.onError(err)
-						return
-					}
-					a.Secret = entity
-					ttl, err := a.Secret.TokenTTL()
-					if err != nil {
-						a.onError(err)
-						return
-					}
-					if ttl == 0 {
-						a.onError(fmt.Errorf("invalid token TTL"))
-						return
-					}
-					LibLogger("Vault token has been refreshed")
-					nextRead = time.After(ttl / 10)
-				}
-			}
-		}()
+	ttl, err := a.Secret.TokenTTL()
+	if err != nil {
+		return err
 	}
+	if ttl == 0 {
+		return fmt.Errorf("invalid token TTL")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	a.refreshing = true
+	a.wg.Add(1)
+	go a.renewLoop(ctx, ttl)
+
 	return nil
 }
 
+// renewLoop renews token until the context is cancelled or renewal is failed
+func (a *VaultTokenAuth) renewLoop(ctx context.Context, ttl time.Duration) {
+	defer a.wg.Done()
+	defer func() {
+		a.mu.Lock()
+		a.refreshing = false
+		a.mu.Unlock()
+	}()
+
+	nextRead := time.After(ttl / 10)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-nextRead:
+			data := map[string]interface{}{"increment": int(ttl.Seconds())}
+			if _, err := vaultRequest(ctx, a.Client, http.MethodPut, "auth/token/renew-self", data); err != nil {
+				a.onError(ctx, err)
+				return
+			}
+			entity, err := a.getTokenEntity(ctx)
+			if err != nil {
+				a.onError(ctx, err)
+				return
+			}
+			a.mu.Lock()
+			a.Secret = entity
+			a.mu.Unlock()
+			if ttl, err = entity.TokenTTL(); err != nil {
+				a.onError(ctx, err)
+				return
+			}
+			if ttl == 0 {
+				a.onError(ctx, fmt.Errorf("invalid token TTL"))
+				return
+			}
+			loggerOrDefault(a.Logger).Info("vault token renewed", "ttl", ttl)
+			nextRead = time.After(ttl / 10)
+		}
+	}
+}
+
+// Stop token renewal, it waits until the renewal goroutine is finished, so it is safe to call it more than once
 func (a *VaultTokenAuth) Stop() {
-	if a.refreshing && a.quit != nil {
-		a.quit <- true
-		close(a.quit)
+	a.mu.Lock()
+	if a.cancel != nil {
+		a.cancel()
+		a.cancel = nil
 	}
+	a.mu.Unlock()
+	a.wg.Wait()
 }
 
-func (a *VaultTokenAuth) onError(err error) {
-	LibLogger(err.Error())
-	close(a.quit)
-	a.refreshing = false
+func (a *VaultTokenAuth) onError(ctx context.Context, err error) {
+	// renewal has been stopped
+	if ctx.Err() != nil {
+		return
+	}
+	loggerOrDefault(a.Logger).Error("vault token renewal failed", "error", err)
 }
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// k8sDataDir is a symlink which is atomically swapped by kubelet on ConfigMap or Secret update
+const k8sDataDir = "..data"
+
+// fileWatcher notifies about changes of the watched files or of any file of the watched directories.
+// Parent directories are watched instead of the files themselves,
+// so atomic renames and kubernetes "..data" symlink swaps are not missed
+type fileWatcher struct {
+	mu      sync.Mutex
+	files   map[string]bool
+	dirs    map[string]bool
+	watcher *fsnotify.Watcher
+	notify  chan struct{}
+}
+
+// newFileWatcher creates watcher for the given files
+func newFileWatcher(files ...string) *fileWatcher {
+	w := &fileWatcher{
+		files:  make(map[string]bool),
+		dirs:   make(map[string]bool),
+		notify: make(chan struct{}, 1),
+	}
+	for _, file := range files {
+		w.files[filepath.Clean(file)] = true
+	}
+	return w
+}
+
+// newDirWatcher creates watcher for all the files of the given directories
+func newDirWatcher(dirs ...string) *fileWatcher {
+	w := newFileWatcher()
+	for _, dir := range dirs {
+		w.dirs[filepath.Clean(dir)] = true
+	}
+	return w
+}
+
+// Watch starts watching (once) and returns the change notification channel, watching errors are logged by logger
+func (w *fileWatcher) Watch(logger Logger) (<-chan struct{}, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.watcher != nil {
+		return w.notify, nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make(map[string]bool)
+	for file := range w.files {
+		dirs[filepath.Dir(file)] = true
+	}
+	for dir := range w.dirs {
+		dirs[dir] = true
+	}
+	for dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			// missing directories are skipped by the readers
+			if w.dirs[dir] && os.IsNotExist(err) {
+				logger.Debug("directory is not found, not watched", "path", dir)
+				continue
+			}
+			_ = watcher.Close()
+			return nil, fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+
+	w.watcher = watcher
+	go w.run(watcher, logger)
+
+	return w.notify, nil
+}
+
+// Stop watching
+func (w *fileWatcher) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.watcher != nil {
+		_ = w.watcher.Close()
+		w.watcher = nil
+	}
+}
+
+func (w *fileWatcher) run(watcher *fsnotify.Watcher, logger Logger) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if w.match(event) {
+				// notification is pending already, skip it
+				select {
+				case w.notify <- struct{}{}:
+				default:
+				}
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warn("file watcher failed", "error", err)
+		}
+	}
+}
+
+// match checks is the event related to the watched files
+func (w *fileWatcher) match(event fsnotify.Event) bool {
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	name := filepath.Clean(event.Name)
+	dir := filepath.Dir(name)
+	if w.files[name] {
+		return true
+	}
+	// kubernetes timestamped directories are swapped by "..data" symlink
+	if w.dirs[dir] {
+		base := filepath.Base(name)
+		return base == k8sDataDir || !strings.HasPrefix(base, "..")
+	}
+	// kubernetes volume has been updated
+	return filepath.Base(name) == k8sDataDir && w.hasFilesIn(dir)
+}
+
+func (w *fileWatcher) hasFilesIn(dir string) bool {
+	for file := range w.files {
+		if filepath.Dir(file) == dir {
+			return true
+		}
+	}
+	return false
+}